@@ -1,8 +1,44 @@
 package main
 
-func WatchSubscribers(newsub, delsub <-chan chan string, statuschange <-chan string) {
-	subs := make([]chan<- string, 0)
-	status := ""
+// A snapshot of the statusline, sent to every subscriber whenever it changes.
+type status struct {
+	// The statusline as plain text, or "" if nothing is being shown.
+	text string
+
+	// The notification being shown.  If nothing is being shown, id is 0.
+	id       uint32
+	app_name string
+	summary  string
+	body     string
+	urgency  urgency
+
+	// Every message of the notification being shown, oldest first.
+	messages []notiftext
+
+	// The actions of the notification being shown.
+	actions []action
+
+	// The index of the message being shown, or -1 if the user is not
+	// seeking, and the number of messages the notification has.
+	seeking_at int
+	revisions  int
+
+	// The number of notifications the user has not seen yet.
+	unread int
+
+	// Whether do not disturb is on.
+	dnd bool
+
+	// What templates render, or nil if nothing is being shown.
+	fields *templateFields
+
+	// The config the status was rendered with.
+	conf *Config
+}
+
+func WatchSubscribers(newsub, delsub <-chan chan *status, statuschange <-chan *status) {
+	subs := make([]chan<- *status, 0)
+	status := &status{seeking_at: -1}
 	for {
 		select {
 		case sub := <-newsub:
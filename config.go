@@ -0,0 +1,419 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A time.Duration that can be written as a string such as "720h" in the
+// config file.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type Config struct {
+	// The path of the Unix socket the remote control server listens on, or
+	// "" to not listen on one.
+	Socket string `toml:"socket"`
+
+	// If TCP is true, the remote control server also listens on the TCP
+	// address Listen.
+	TCP    bool   `toml:"tcp"`
+	Listen string `toml:"listen"`
+
+	// If not "", TCP clients must send "auth <token>" before anything else.
+	Token string `toml:"token"`
+
+	// If set, TCP clients must connect using TLS with this certificate and
+	// key.
+	TLSCert string `toml:"tls_cert"`
+	TLSKey  string `toml:"tls_key"`
+
+	// Placed between the summary and body of a notification on the
+	// statusline.
+	Separator string `toml:"separator"`
+
+	// The colors bars show notifications of each urgency in, such as
+	// "#ff0000", or "" for the bar's default color.
+	Colors struct {
+		Low      string `toml:"low"`
+		Normal   string `toml:"normal"`
+		Critical string `toml:"critical"`
+	} `toml:"colors"`
+
+	Display struct {
+		// The most terminal cells the statusline may take up, or 0 for no
+		// limit.  Statuslines that are too long are truncated, or scroll if
+		// overflow is "marquee".
+		MaxWidth int    `toml:"max_width"`
+		Overflow string `toml:"overflow"`
+
+		// How often a scrolling statusline moves.
+		ScrollInterval duration `toml:"scroll_interval"`
+	} `toml:"display"`
+
+	// Do not disturb: while it is on, new notifications are kept but not
+	// shown, and the indicator and the number of unread notifications are
+	// shown instead.  It is turned on by the dnd command, or during the quiet
+	// hours, which are periods like "22:00-07:00".
+	DND struct {
+		QuietHours    []string `toml:"quiet_hours"`
+		Indicator     string   `toml:"indicator"`
+		AllowCritical bool     `toml:"allow_critical"`
+	} `toml:"dnd"`
+
+	// The parsed DND.QuietHours.
+	quietHours []quietPeriod
+
+	Timeouts struct {
+		// How long, in seconds, low and normal urgency notifications are
+		// shown for when they don't specify their own timeout.
+		Low    int `toml:"low"`
+		Normal int `toml:"normal"`
+	} `toml:"timeouts"`
+
+	// What GetServerInformation reports to applications.
+	Server struct {
+		Name    string `toml:"name"`
+		Vendor  string `toml:"vendor"`
+		Version string `toml:"version"`
+	} `toml:"server"`
+
+	History struct {
+		Enabled bool   `toml:"enabled"`
+		File    string `toml:"file"`
+
+		// How long to keep notifications in the history, or 0 to keep them
+		// forever.
+		Retention duration `toml:"retention"`
+	} `toml:"history"`
+
+	// How much is kept, or 0 for no limit.  When there are too many
+	// notifications, overall or from one app, the oldest ones that have been
+	// seen are closed and forgotten first.  Notifications only keep their
+	// latest revisions.
+	Limits struct {
+		Notifications int `toml:"notifications"`
+		PerApp        int `toml:"per_app"`
+		Revisions     int `toml:"revisions"`
+	} `toml:"limits"`
+
+	// text/template templates for the statusline.  default and apps, which
+	// is keyed by app name, render plain text that each output format
+	// escapes.  formats, keyed by output format name, replace the statusline
+	// of that format entirely, and are not escaped.
+	Templates struct {
+		Default string            `toml:"default"`
+		Apps    map[string]string `toml:"apps"`
+		Formats map[string]string `toml:"formats"`
+	} `toml:"templates"`
+
+	// The compiled Templates.
+	templates *templateSet
+
+	// Rules that filter and change notifications as they arrive.
+	Rules []ruleConfig `toml:"rules"`
+
+	// The compiled Rules.
+	rules []*rule
+}
+
+func defaultConfig() *Config {
+	c := &Config{
+		Socket:    defaultSocketPath(),
+		Listen:    "localhost:8082",
+		Separator: " | ",
+	}
+	c.Colors.Low = "#888888"
+	c.Colors.Critical = "#ff5555"
+	c.Display.Overflow = "truncate"
+	c.Display.ScrollInterval.Duration = 300 * time.Millisecond
+	c.DND.Indicator = "🔕"
+	c.Timeouts.Low = defaultLowTimeout
+	c.Timeouts.Normal = defaultNormalTimeout
+	c.Server.Name = "simplenotif"
+	c.Server.Vendor = "https://dkess.me"
+	c.Server.Version = "0.0.0"
+	c.History.File = defaultHistoryPath()
+	c.History.Retention.Duration = 30 * 24 * time.Hour
+	c.Limits.Notifications = 1000
+	c.Limits.Revisions = 100
+	c.Templates.Default = defaultTemplate
+	c.compileTemplates()
+	return c
+}
+
+// defaultSocketPath returns the path of the control socket under
+// $XDG_RUNTIME_DIR.
+func defaultSocketPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return filepath.Join(os.TempDir(),
+			fmt.Sprintf("simplenotif-%d.sock", os.Getuid()))
+	}
+	return filepath.Join(dir, "simplenotif.sock")
+}
+
+// defaultConfigPath returns the path of the config file under
+// $XDG_CONFIG_HOME.
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "simplenotif", "config.toml")
+}
+
+// loadConfig reads the config file at path on top of the defaults.  If
+// mustExist is false, a missing file is not an error.
+func loadConfig(path string, mustExist bool) (*Config, error) {
+	c := defaultConfig()
+	if _, err := os.Stat(path); os.IsNotExist(err) && !mustExist {
+		return c, nil
+	}
+
+	md, err := toml.DecodeFile(path, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return nil, fmt.Errorf("%s: unknown keys: %s", path,
+			strings.Join(keys, ", "))
+	}
+	return c, nil
+}
+
+// validate returns an error describing the first problem with the config.
+func (c *Config) validate() error {
+	if c.Socket == "" && !c.TCP {
+		return fmt.Errorf("socket: must be set unless tcp is enabled")
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); c.TCP && err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+	if strings.ContainsAny(c.Token, " \t\r\n") {
+		return fmt.Errorf("token: must not contain whitespace")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	for name, color := range map[string]string{
+		"low":      c.Colors.Low,
+		"normal":   c.Colors.Normal,
+		"critical": c.Colors.Critical,
+	} {
+		if color != "" && !validColor(color) {
+			return fmt.Errorf("colors.%s: %q is not a color like #rrggbb",
+				name, color)
+		}
+	}
+	if c.Display.MaxWidth < 0 {
+		return fmt.Errorf("display.max_width: must not be negative")
+	}
+	if c.Display.Overflow != "truncate" && c.Display.Overflow != "marquee" {
+		return fmt.Errorf("display.overflow: must be \"truncate\" or \"marquee\"")
+	}
+	if c.Display.ScrollInterval.Duration <= 0 {
+		return fmt.Errorf("display.scroll_interval: must be positive")
+	}
+	if c.Timeouts.Low < 0 || c.Timeouts.Low > 65535 {
+		return fmt.Errorf("timeouts.low: must be between 0 and 65535")
+	}
+	if c.Timeouts.Normal < 0 || c.Timeouts.Normal > 65535 {
+		return fmt.Errorf("timeouts.normal: must be between 0 and 65535")
+	}
+	if c.Server.Name == "" {
+		return fmt.Errorf("server.name: must not be empty")
+	}
+	if c.History.Enabled && c.History.File == "" {
+		return fmt.Errorf("history.file: must not be empty")
+	}
+	if c.History.Retention.Duration < 0 {
+		return fmt.Errorf("history.retention: must not be negative")
+	}
+	for name, limit := range map[string]int{
+		"notifications": c.Limits.Notifications,
+		"per_app":       c.Limits.PerApp,
+		"revisions":     c.Limits.Revisions,
+	} {
+		if limit < 0 {
+			return fmt.Errorf("limits.%s: must not be negative", name)
+		}
+	}
+	if err := c.compileQuietHours(); err != nil {
+		return err
+	}
+	if err := c.compileRules(); err != nil {
+		return err
+	}
+	return c.compileTemplates()
+}
+
+// validColor returns true if color is of the form #rrggbb or #rrggbbaa.
+func validColor(color string) bool {
+	if (len(color) != 7 && len(color) != 9) || color[0] != '#' {
+		return false
+	}
+	for _, r := range color[1:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// keepStartupSettings copies the settings that are only read at startup from
+// old into c, and returns the names of the ones that differed.
+func (c *Config) keepStartupSettings(old *Config) []string {
+	var changed []string
+	if c.Socket != old.Socket {
+		changed = append(changed, "socket")
+		c.Socket = old.Socket
+	}
+	if c.TCP != old.TCP {
+		changed = append(changed, "tcp")
+		c.TCP = old.TCP
+	}
+	if c.Listen != old.Listen {
+		changed = append(changed, "listen")
+		c.Listen = old.Listen
+	}
+	if c.Token != old.Token {
+		changed = append(changed, "token")
+		c.Token = old.Token
+	}
+	if c.TLSCert != old.TLSCert || c.TLSKey != old.TLSKey {
+		changed = append(changed, "tls_cert", "tls_key")
+		c.TLSCert = old.TLSCert
+		c.TLSKey = old.TLSKey
+	}
+	if c.Server != old.Server {
+		changed = append(changed, "server")
+		c.Server = old.Server
+	}
+	if c.History.Enabled != old.History.Enabled {
+		changed = append(changed, "history.enabled")
+		c.History.Enabled = old.History.Enabled
+	}
+	if c.History.File != old.History.File {
+		changed = append(changed, "history.file")
+		c.History.File = old.History.File
+	}
+	return changed
+}
+
+// The command-line flags, which override the values in the config file.
+type configFlags struct {
+	path          *string
+	socket        *string
+	tcp           *bool
+	listen        *string
+	token         *string
+	tlsCert       *string
+	tlsKey        *string
+	separator     *string
+	lowTimeout    *int
+	normalTimeout *int
+	history       *bool
+	historyFile   *string
+	retention     *time.Duration
+}
+
+func registerConfigFlags() *configFlags {
+	d := defaultConfig()
+	return &configFlags{
+		path: flag.String("config", defaultConfigPath(),
+			"the config file to read"),
+		socket: flag.String("socket", d.Socket,
+			"the Unix socket to listen on for remote control"),
+		tcp: flag.Bool("tcp", d.TCP,
+			"also listen for remote control over TCP"),
+		listen: flag.String("listen", d.Listen,
+			"the TCP address to listen on when -tcp is given"),
+		token: flag.String("token", d.Token,
+			"the token TCP clients must authenticate with"),
+		tlsCert: flag.String("tls-cert", d.TLSCert,
+			"the TLS certificate to use for TCP clients"),
+		tlsKey: flag.String("tls-key", d.TLSKey,
+			"the TLS key to use for TCP clients"),
+		separator: flag.String("separator", d.Separator,
+			"placed between the summary and body of a notification"),
+		lowTimeout: flag.Int("low-timeout", d.Timeouts.Low,
+			"seconds to show low urgency notifications for"),
+		normalTimeout: flag.Int("normal-timeout", d.Timeouts.Normal,
+			"seconds to show normal urgency notifications for"),
+		history: flag.Bool("history", d.History.Enabled,
+			"keep the notification history on disk across restarts"),
+		historyFile: flag.String("history-file", d.History.File,
+			"where to store the notification history"),
+		retention: flag.Duration("history-retention",
+			d.History.Retention.Duration,
+			"how long to keep notifications in the history, or 0 to keep them forever"),
+	}
+}
+
+// load reads the config file named by the flags, then applies every flag
+// that was given on the command line on top of it.
+func (f *configFlags) load() (*Config, error) {
+	pathGiven := false
+	flag.Visit(func(fl *flag.Flag) {
+		if fl.Name == "config" {
+			pathGiven = true
+		}
+	})
+
+	c, err := loadConfig(*f.path, pathGiven)
+	if err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "socket":
+			c.Socket = *f.socket
+		case "tcp":
+			c.TCP = *f.tcp
+		case "listen":
+			c.Listen = *f.listen
+		case "token":
+			c.Token = *f.token
+		case "tls-cert":
+			c.TLSCert = *f.tlsCert
+		case "tls-key":
+			c.TLSKey = *f.tlsKey
+		case "separator":
+			c.Separator = *f.separator
+		case "low-timeout":
+			c.Timeouts.Low = *f.lowTimeout
+		case "normal-timeout":
+			c.Timeouts.Normal = *f.normalTimeout
+		case "history":
+			c.History.Enabled = *f.history
+		case "history-file":
+			c.History.File = *f.historyFile
+		case "history-retention":
+			c.History.Retention.Duration = *f.retention
+		}
+	})
+
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	c, err := loadConfig(filepath.Join(dir, "missing.toml"), false)
+	if err != nil || c.Socket != defaultConfig().Socket {
+		t.Error("missing config file should give the defaults:", err)
+	}
+	if _, err := loadConfig(filepath.Join(dir, "missing.toml"), true); err == nil {
+		t.Error("missing config file given explicitly should be an error")
+	}
+
+	c, err = loadConfig(write("good.toml", `
+tcp = true
+listen = "localhost:9000"
+separator = " - "
+
+[timeouts]
+normal = 20
+
+[history]
+enabled = true
+retention = "48h"
+`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.TCP || c.Listen != "localhost:9000" || c.Separator != " - " {
+		t.Error("top level keys not read")
+	}
+	if c.Timeouts.Normal != 20 || c.Timeouts.Low != defaultLowTimeout {
+		t.Error("timeouts not read on top of the defaults")
+	}
+	if !c.History.Enabled || c.History.Retention.Duration != 48*time.Hour {
+		t.Error("history settings not read")
+	}
+	if err := c.validate(); err != nil {
+		t.Error("valid config failed validation:", err)
+	}
+
+	if _, err := loadConfig(write("typo.toml", `seperator = "-"`), true); err == nil {
+		t.Error("unknown key was accepted")
+	}
+
+	c, err = loadConfig(write("bad.toml", `
+[timeouts]
+low = -1
+`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err == nil {
+		t.Error("negative timeout passed validation")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	nfs, statuschange, _ := newTestState(defaultConfig())
+	makeTestNotif(nfs, 0, "1", "0")
+	<-statuschange
+
+	nfs.loadConf = func() (*Config, error) {
+		return nil, errors.New("bad config")
+	}
+	if nfs.ReloadConfig() == nil {
+		t.Error("failed reload did not return an error")
+	}
+	if nfs.conf.Separator != " | " || len(statuschange) != 0 {
+		t.Error("failed reload changed the config")
+	}
+
+	nfs.loadConf = func() (*Config, error) {
+		c := defaultConfig()
+		c.Separator = " - "
+		c.Listen = ":9999"
+		return c, nil
+	}
+	nfs.ReloadConfig()
+	if status := <-statuschange; status.text != "1 - 0" {
+		t.Error("statusline not redrawn with the new config:", status.text)
+	}
+	if nfs.conf.Listen != defaultConfig().Listen {
+		t.Error("listen address changed without a restart")
+	}
+	if nfs.notifList.Len() != 1 || nfs.currently_showing == nil {
+		t.Error("reloading changed the notification list")
+	}
+
+	// The reload command also picks up new quiet hours and scroll interval
+	nfs.marquee = time.NewTicker(time.Hour)
+	defer nfs.marquee.Stop()
+	nfs.loadConf = func() (*Config, error) {
+		c := defaultConfig()
+		c.DND.QuietHours = []string{"14:00-16:00"}
+		c.Display.ScrollInterval.Duration = time.Millisecond
+		return c, c.validate()
+	}
+	if _, err := nfs.RunCommand(&remoteCommand{button: Reload}); err != nil {
+		t.Fatal(err)
+	}
+	if !nfs.dnd_active {
+		t.Error("reload did not turn on do not disturb for new quiet hours")
+	}
+	if _, ok := nfs.sched.Deadline(timerKey{0, TimerDND}); !ok {
+		t.Error("reload did not schedule the end of the quiet hours")
+	}
+	select {
+	case <-nfs.marquee.C:
+	case <-time.After(time.Second):
+		t.Error("reload did not change the scroll interval")
+	}
+}
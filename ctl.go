@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// executable returns the path of the running simplenotif.
+func executable() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "simplenotif"
+	}
+	return exe
+}
+
+// ctlCommand returns the shell command bars run to send a command back to the
+// simplenotif listening on socket, such as
+// "'/usr/bin/simplenotif' -socket '/run/user/1000/simplenotif.sock' ctl".
+func ctlCommand(exe, socket string) string {
+	cmd := shellQuote(exe)
+	if socket != "" {
+		cmd += " -socket " + shellQuote(socket)
+	}
+	return cmd + " ctl"
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runCtl sends a single command to the running simplenotif over its Unix
+// socket, and copies anything sent back, such as the result of a query, to
+// stdout.
+func runCtl(conf *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: simplenotif ctl <command> [args...]")
+	}
+	if conf.Socket == "" {
+		return errors.New("ctl needs the Unix socket to be enabled")
+	}
+
+	conn, err := net.Dial("unix", conf.Socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, strings.Join(args, " ")+"\n"); err != nil {
+		return err
+	}
+	// The server disconnects once it has handled the command and seen that
+	// nothing else is coming.
+	conn.(*net.UnixConn).CloseWrite()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
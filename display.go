@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/rivo/uniseg"
+	"strings"
+	"time"
+)
+
+// Placed between the end of a scrolling statusline and its start.
+const marqueeGap = "   "
+
+// displayWidth returns how many terminal cells s takes up, counting wide
+// characters such as CJK and emoji as two.
+func displayWidth(s string) int {
+	return uniseg.StringWidth(s)
+}
+
+// A grapheme cluster, the unit text is cut into so that combining marks and
+// emoji sequences are never split.
+type grapheme struct {
+	text  string
+	width int
+}
+
+func graphemes(s string) []grapheme {
+	var gs []grapheme
+	state := -1
+	for s != "" {
+		var g string
+		var w int
+		g, s, w, state = uniseg.FirstGraphemeClusterInString(s, state)
+		gs = append(gs, grapheme{g, w})
+	}
+	return gs
+}
+
+// truncateWidth shortens s to at most width cells, ending it with "…" if
+// anything was cut off.
+func truncateWidth(s string, width int) string {
+	if displayWidth(s) <= width {
+		return s
+	}
+	if width <= 0 {
+		return ""
+	}
+	var b strings.Builder
+	used := 0
+	for _, g := range graphemes(s) {
+		if used+g.width > width-1 {
+			break
+		}
+		b.WriteString(g.text)
+		used += g.width
+	}
+	return b.String() + "…"
+}
+
+// padWidth adds spaces to the end of s until it is at least width cells wide.
+func padWidth(s string, width int) string {
+	if w := displayWidth(s); w < width {
+		return s + strings.Repeat(" ", width-w)
+	}
+	return s
+}
+
+// marqueeWindow returns width cells of s followed by marqueeGap, starting at
+// the offset'th grapheme and wrapping around to the start.
+func marqueeWindow(s string, width, offset int) string {
+	gs := graphemes(s + marqueeGap)
+	var b strings.Builder
+	used := 0
+	for i := 0; used < width; i++ {
+		g := gs[(offset+i)%len(gs)]
+		if used+g.width > width {
+			// A wide character that doesn't fit is replaced by spaces
+			b.WriteString(strings.Repeat(" ", width-used))
+			break
+		}
+		b.WriteString(g.text)
+		used += g.width
+	}
+	return b.String()
+}
+
+// fitStatusline makes the statusline text fit in the configured width,
+// truncating it or scrolling it as configured.
+func (s *nfState) fitStatusline(text string) string {
+	width := s.conf.Display.MaxWidth
+	s.marquee_length = 0
+	if width <= 0 || displayWidth(text) <= width {
+		return text
+	}
+	if s.conf.Display.Overflow != "marquee" {
+		return truncateWidth(text, width)
+	}
+
+	if text != s.marquee_text {
+		s.marquee_text = text
+		s.marquee_offset = 0
+	}
+	s.marquee_length = len(graphemes(text + marqueeGap))
+	return marqueeWindow(text, width, s.marquee_offset)
+}
+
+// ScrollMarquee scrolls the statusline if it is too long to fit.  Scrolling
+// is paused while seeking.  It speeds up if needed so that the whole text
+// scrolls past before the notification expires.
+func (s *nfState) ScrollMarquee() {
+	if s.marquee_length == 0 || s.currently_showing == nil || s.seeking_at >= 0 {
+		return
+	}
+
+	step := 1
+	interval := s.conf.Display.ScrollInterval.Duration
+	if s.shown_for > 0 && interval > 0 {
+		ticks := int(time.Duration(s.shown_for) * time.Second / interval)
+		if ticks > 0 && s.marquee_length > ticks {
+			step = (s.marquee_length + ticks - 1) / ticks
+		}
+	}
+	s.marquee_offset = (s.marquee_offset + step) % s.marquee_length
+	s.updateStatus()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDisplayWidth(t *testing.T) {
+	if w := displayWidth("日本語 ok"); w != 9 {
+		t.Error("CJK should be two cells wide, got", w)
+	}
+	if got := truncateWidth("日本語です", 6); got != "日本…" {
+		t.Error("bad truncation:", got)
+	}
+	if got := truncateWidth("ééé", 2); got != "é…" {
+		t.Error("combining marks were split:", got)
+	}
+	if got := padWidth("日本", 6); got != "日本  " {
+		t.Errorf("bad padding: %q", got)
+	}
+	if got := marqueeWindow("abcdef", 4, 5); got != "f   " {
+		t.Errorf("bad marquee window: %q", got)
+	}
+	if got := marqueeWindow("a日本", 2, 0); got != "a " {
+		t.Errorf("wide character should not be split: %q", got)
+	}
+}
+
+func TestMarquee(t *testing.T) {
+	c := defaultConfig()
+	c.Display.MaxWidth = 6
+	c.Display.Overflow = "marquee"
+
+	nfs, statuschange, _ := newTestState(c)
+
+	nfs.HandleNotifEvent(&notifEvent{
+		text:           notiftext{nfs.clock.Now(), "abc", "defgh"},
+		expire_timeout: -1,
+		id:             make(chan uint32, 1),
+	})
+	if st := <-statuschange; st.text != "abc | " {
+		t.Error("marquee should start at the beginning:", st.text)
+	}
+	nfs.ScrollMarquee()
+	if st := <-statuschange; st.text != "bc | d" {
+		t.Error("marquee did not scroll:", st.text)
+	}
+
+	// 14 graphemes with the gap must scroll past within one 300ms tick
+	nfs.shown_for = 1
+	nfs.marquee_offset = 0
+	nfs.ScrollMarquee()
+	if st := <-statuschange; st.text != " defgh" {
+		t.Error("marquee did not speed up to fit the timeout:", st.text)
+	}
+
+	nfs.SeekPrevMsg()
+	for len(statuschange) > 0 {
+		<-statuschange
+	}
+	nfs.ScrollMarquee()
+	if len(statuschange) != 0 {
+		t.Error("marquee scrolled while seeking")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A period of quiet hours, in minutes since midnight.  If end is before
+// start, the period wraps around midnight.
+type quietPeriod struct {
+	start, end int
+}
+
+// parseClock parses a time of day such as "22:30" into minutes since
+// midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time like 22:30", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseQuietPeriod parses quiet hours such as "22:00-07:00".
+func parseQuietPeriod(s string) (quietPeriod, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return quietPeriod{}, fmt.Errorf("%q is not a period like 22:00-07:00", s)
+	}
+	start, err := parseClock(strings.TrimSpace(from))
+	if err != nil {
+		return quietPeriod{}, err
+	}
+	end, err := parseClock(strings.TrimSpace(to))
+	if err != nil {
+		return quietPeriod{}, err
+	}
+	return quietPeriod{start, end}, nil
+}
+
+// compileQuietHours parses the configured quiet hours.
+func (c *Config) compileQuietHours() error {
+	var periods []quietPeriod
+	for _, s := range c.DND.QuietHours {
+		p, err := parseQuietPeriod(s)
+		if err != nil {
+			return fmt.Errorf("dnd.quiet_hours: %v", err)
+		}
+		periods = append(periods, p)
+	}
+	c.quietHours = periods
+	return nil
+}
+
+// quietUntil returns when the quiet hours that now is in end, or false if now
+// is not in any quiet hours.
+func (c *Config) quietUntil(now time.Time) (time.Time, bool) {
+	m := now.Hour()*60 + now.Minute()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+		now.Location())
+	for _, p := range c.quietHours {
+		var in bool
+		if p.start <= p.end {
+			in = p.start <= m && m < p.end
+		} else {
+			in = m >= p.start || m < p.end
+		}
+		if !in {
+			continue
+		}
+		end := midnight.Add(time.Duration(p.end) * time.Minute)
+		if !end.After(now) {
+			end = end.AddDate(0, 0, 1)
+		}
+		return end, true
+	}
+	return time.Time{}, false
+}
+
+// nextClock returns the next time after now that the clock shows the given
+// minutes since midnight.
+func nextClock(now time.Time, minutes int) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+		now.Location()).Add(time.Duration(minutes) * time.Minute)
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// nextQuietChange returns the next time after now that quiet hours start or
+// end, or false if there are no quiet hours.
+func (c *Config) nextQuietChange(now time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, p := range c.quietHours {
+		for _, m := range []int{p.start, p.end} {
+			if t := nextClock(now, m); next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// scheduleDND sets the deadline for the next time do not disturb might turn
+// on or off.
+func (s *nfState) scheduleDND() {
+	now := s.clock.Now()
+	var next time.Time
+	for _, t := range []time.Time{s.dnd_until, s.dnd_off_until} {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	if t, ok := s.conf.nextQuietChange(now); ok && (next.IsZero() || t.Before(next)) {
+		next = t
+	}
+
+	key := timerKey{0, TimerDND}
+	if next.IsZero() {
+		s.sched.Cancel(key)
+	} else {
+		s.sched.Schedule(key, next)
+	}
+}
+
+// dndActive returns true if do not disturb is on at now, either because the
+// user turned it on or because of the quiet hours.
+func (s *nfState) dndActive(now time.Time) bool {
+	if s.dnd_on && (s.dnd_until.IsZero() || now.Before(s.dnd_until)) {
+		return true
+	}
+	if now.Before(s.dnd_off_until) {
+		return false
+	}
+	_, quiet := s.conf.quietUntil(now)
+	return quiet
+}
+
+// CheckDND turns do not disturb on or off if it is time to.  When it turns
+// off, the notifications that arrived in the meantime are shown.
+func (s *nfState) CheckDND() {
+	now := s.clock.Now()
+	if s.dnd_on && !s.dnd_until.IsZero() && !now.Before(s.dnd_until) {
+		s.dnd_on = false
+		s.dnd_until = time.Time{}
+	}
+
+	defer s.scheduleDND()
+
+	active := s.dndActive(now)
+	if active == s.dnd_active {
+		return
+	}
+	s.dnd_active = active
+	if !active && s.shouldInterrupt(UrgencyNormal) {
+		s.interrupt()
+	} else {
+		s.updateStatus()
+	}
+}
+
+// dndIndicator returns what is shown on the statusline instead of new
+// notifications while do not disturb is on.
+func (s *nfState) dndIndicator() string {
+	if n := s.unreadCount(); n > 0 {
+		return s.conf.DND.Indicator + " " + strconv.Itoa(n)
+	}
+	return s.conf.DND.Indicator
+}
+
+// The result of "dnd": whether do not disturb is on, and until when.
+type dndResult struct {
+	Active bool       `json:"active"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+func (r *dndResult) lines() []string {
+	if !r.Active {
+		return []string{"off"}
+	}
+	if r.Until == nil {
+		return []string{"on"}
+	}
+	return []string{"on until " + r.Until.Format(time.RFC3339)}
+}
+
+// dndState returns whether do not disturb is on, and until when.
+func (s *nfState) dndState() *dndResult {
+	now := s.clock.Now()
+	r := &dndResult{Active: s.dndActive(now)}
+	if !r.Active {
+		return r
+	}
+	until := s.dnd_until
+	if !s.dnd_on {
+		until, _ = s.conf.quietUntil(now)
+	}
+	if !until.IsZero() {
+		r.Until = &until
+	}
+	return r
+}
+
+// SetDND carries out "dnd on", "dnd off", "dnd toggle" or "dnd until <time>",
+// where the time is either a time of day such as "07:30" or a duration such
+// as "45m".
+func (s *nfState) SetDND(args []string) error {
+	usage := errors.New("usage: dnd [on|off|toggle|until <time>]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	now := s.clock.Now()
+	on := false
+	var until time.Time
+	switch args[0] {
+	case "on":
+		on = true
+	case "off":
+	case "toggle":
+		on = !s.dndActive(now)
+	case "until":
+		if len(args) != 2 {
+			return usage
+		}
+		if d, err := time.ParseDuration(args[1]); err == nil && d > 0 {
+			until = now.Add(d)
+		} else if m, err := parseClock(args[1]); err == nil {
+			until = nextClock(now, m)
+		} else {
+			return fmt.Errorf("%q is not a time like 07:30 or a duration like 45m",
+				args[1])
+		}
+		on = true
+	default:
+		return usage
+	}
+	if len(args) > 1 && args[0] != "until" {
+		return usage
+	}
+
+	s.dnd_on = on
+	s.dnd_until = until
+	s.dnd_off_until = time.Time{}
+	if !on {
+		// Stay off until the quiet hours we are in are over
+		if end, quiet := s.conf.quietUntil(now); quiet {
+			s.dnd_off_until = end
+		}
+	}
+	s.CheckDND()
+	return nil
+}
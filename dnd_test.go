@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	c := defaultConfig()
+	c.DND.QuietHours = []string{"22:00-07:00", "12:00-13:00"}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	at := func(h, m int) time.Time {
+		return time.Date(2020, 3, 10, h, m, 0, 0, time.Local)
+	}
+	for _, tc := range []struct {
+		now   time.Time
+		quiet bool
+		until time.Time
+	}{
+		{at(23, 0), true, at(31, 0)},
+		{at(6, 59), true, at(7, 0)},
+		{at(7, 0), false, time.Time{}},
+		{at(12, 30), true, at(13, 0)},
+		{at(21, 59), false, time.Time{}},
+	} {
+		until, quiet := c.quietUntil(tc.now)
+		if quiet != tc.quiet || !until.Equal(tc.until) {
+			t.Errorf("at %v: got %v until %v", tc.now, quiet, until)
+		}
+	}
+
+	c.DND.QuietHours = []string{"22:00"}
+	if c.validate() == nil {
+		t.Error("quiet hours without an end were accepted")
+	}
+}
+
+func TestDND(t *testing.T) {
+	nfs, statuschange, _ := newTestState(defaultConfig())
+	drain := func() *status {
+		var st *status
+		for len(statuschange) > 0 {
+			st = <-statuschange
+		}
+		return st
+	}
+
+	if err := nfs.SetDND([]string{"on"}); err != nil {
+		t.Fatal(err)
+	}
+	if st := drain(); st == nil || st.text != "🔕" || !st.dnd {
+		t.Error("indicator not shown:", st)
+	}
+
+	makeTestNotif(nfs, 0, "a", "b")
+	makeTestNotif(nfs, 0, "c", "d")
+	if nfs.currently_showing != nil {
+		t.Error("notification shown during do not disturb")
+	}
+	if st := drain(); st == nil || st.text != "🔕 2" {
+		t.Error("indicator does not count unread notifications:", st)
+	}
+
+	nfs.HandleNotifEvent(&notifEvent{
+		text:    notiftext{nfs.clock.Now(), "e", "f"},
+		urgency: UrgencyCritical,
+		id:      make(chan uint32, 1),
+	})
+	if nfs.currently_showing != nil {
+		t.Error("critical notification broke through when not allowed")
+	}
+	nfs.conf.DND.AllowCritical = true
+	nfs.nextStatus(true)
+	if nfs.currently_showing == nil ||
+		nfs.currently_showing.Value.(*notif).urgency != UrgencyCritical {
+		t.Error("critical notification did not break through")
+	}
+	nfs.DismissCurrent()
+	drain()
+
+	if r := nfs.dndState(); !r.Active || r.Until != nil {
+		t.Error("bad dnd state:", r)
+	}
+	if err := nfs.SetDND([]string{"toggle"}); err != nil {
+		t.Fatal(err)
+	}
+	st := drain()
+	if st == nil || st.dnd || st.text != "a | b" {
+		t.Error("queued notifications not shown after do not disturb:", st)
+	}
+
+	if err := nfs.SetDND([]string{"until", "45m"}); err != nil {
+		t.Fatal(err)
+	}
+	advance(nfs, 30*time.Minute)
+	if !nfs.dnd_active {
+		t.Error("do not disturb ended early")
+	}
+	advance(nfs, 15*time.Minute)
+	if nfs.dnd_active || nfs.dnd_on {
+		t.Error("do not disturb did not end on time")
+	}
+	if nfs.SetDND([]string{"until", "soon"}) == nil {
+		t.Error("bad time was accepted")
+	}
+}
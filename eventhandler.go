@@ -6,14 +6,47 @@ import (
 )
 */
 
+// The reasons a notification can be closed, as given in the
+// NotificationClosed signal.
+type closeReason uint32
+
+const (
+	ReasonExpired   closeReason = 1
+	ReasonDismissed closeReason = 2
+	ReasonClosed    closeReason = 3
+	ReasonUndefined closeReason = 4
+)
+
+// A signal to be emitted on the org.freedesktop.Notifications interface.
+type dbusSignal struct {
+	name string
+	body []interface{}
+}
+
 type eventHandler struct {
-	notify chan *notifEvent
-	close  chan uint32
+	notify  chan *notifEvent
+	close   chan uint32
+	signals chan *dbusSignal
+
+	// The clock that notifications are timestamped with, which also times
+	// the deadlines of the event loop.  The marquee and the ages on the
+	// statusline are redrawn by real tickers.
+	clock clock
+
+	// The server information reported by GetServerInformation.
+	name    string
+	vendor  string
+	version string
 }
 
-func NewEventHandler() *eventHandler {
+func NewEventHandler(conf *Config) *eventHandler {
 	return &eventHandler{
-		notify: make(chan *notifEvent),
-		close:  make(chan uint32),
+		notify:  make(chan *notifEvent),
+		close:   make(chan uint32),
+		signals: make(chan *dbusSignal, 64),
+		clock:   realClock{},
+		name:    conf.Server.Name,
+		vendor:  conf.Server.Vendor,
+		version: conf.Server.Version,
 	}
 }
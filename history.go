@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The journal is compacted once it holds this many more records than there
+// are notifications in the list.
+const journalSlack = 1000
+
+// A journal of every change to the notification list, stored on disk as one
+// JSON object per line, so that the history survives restarts.
+type journal struct {
+	path string
+
+	// Notifications whose last message is older than this are dropped when
+	// the journal is compacted.  If 0, notifications are kept forever.
+	retention time.Duration
+
+	file *os.File
+
+	// The number of records in the file.
+	records int
+}
+
+type journalText struct {
+	Time    time.Time `json:"time"`
+	Summary string    `json:"summary"`
+	Body    string    `json:"body"`
+}
+
+// A single line in the journal.  Op is one of:
+//
+//	"add":     a new notification, with every message it has
+//	"replace": a notification was replaced; Text holds the new message
+//	"seen":    a notification was seen by the user
+//	"unseen":  a notification is to be shown again, and moved to the back
+//	"snooze":  a notification was snoozed until Until
+//	"remove":  a notification was removed from the list
+//	"clear":   every notification was removed from the list
+type journalEntry struct {
+	Op            string        `json:"op"`
+	Id            uint32        `json:"id,omitempty"`
+	AppName       string        `json:"app_name,omitempty"`
+	AppIcon       string        `json:"app_icon,omitempty"`
+	Text          []journalText `json:"text,omitempty"`
+	Actions       []string      `json:"actions,omitempty"`
+	Urgency       urgency       `json:"urgency,omitempty"`
+	Category      string        `json:"category,omitempty"`
+	Resident      bool          `json:"resident,omitempty"`
+	ExpireTimeout int32         `json:"expire_timeout,omitempty"`
+	Seen          bool          `json:"seen,omitempty"`
+	Until         *time.Time    `json:"until,omitempty"`
+}
+
+// defaultHistoryPath returns the path of the journal under $XDG_STATE_HOME.
+func defaultHistoryPath() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".local", "state")
+	}
+	return filepath.Join(dir, "simplenotif", "history.jsonl")
+}
+
+func newJournal(path string, retention time.Duration) *journal {
+	return &journal{
+		path:      path,
+		retention: retention,
+	}
+}
+
+// load reads every entry in the journal.  A missing file is not an error.
+func (j *journal) load() ([]*journalEntry, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		e := &journalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			// A partially written last line can be left behind by a crash
+			fmt.Fprintln(os.Stderr, "skipping bad history entry:", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// write appends an entry to the journal.
+func (j *journal) write(e *journalEntry) error {
+	if j.file == nil {
+		if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(j.path,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		j.file = f
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.records++
+	_, err = j.file.Write(append(b, '\n'))
+	return err
+}
+
+// rewrite atomically replaces the contents of the journal with entries.
+func (j *journal) rewrite(entries []*journalEntry) error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	j.records = len(entries)
+	return nil
+}
+
+func notifEntry(p *notif) *journalEntry {
+	e := &journalEntry{
+		Op:            "add",
+		Id:            p.id,
+		AppName:       p.app_name,
+		AppIcon:       p.app_icon,
+		Actions:       p.actions,
+		Urgency:       p.urgency,
+		Category:      p.category,
+		Resident:      p.resident,
+		ExpireTimeout: p.expire_timeout,
+		Seen:          p.seen_by_user,
+	}
+	for _, t := range p.text {
+		e.Text = append(e.Text, journalText{t.time, t.summary, t.body})
+	}
+	return e
+}
+
+// record writes e to the journal, if there is one, and compacts the journal
+// once it has grown too large.
+func (s *nfState) record(e *journalEntry) {
+	if s.history == nil {
+		return
+	}
+	if err := s.history.write(e); err != nil {
+		fmt.Fprintln(os.Stderr, "could not write history:", err)
+	}
+	if s.history.records > s.notifList.Len()*2+journalSlack {
+		s.compactHistory()
+	}
+}
+
+func (s *nfState) recordAdd(p *notif) {
+	if !p.transient {
+		s.record(notifEntry(p))
+	}
+}
+
+func (s *nfState) recordReplace(p *notif) {
+	if p.transient {
+		return
+	}
+	e := notifEntry(p)
+	e.Op = "replace"
+	e.Text = e.Text[len(e.Text)-1:]
+	s.record(e)
+}
+
+func (s *nfState) recordSeen(p *notif) {
+	if !p.transient {
+		s.record(&journalEntry{Op: "seen", Id: p.id})
+	}
+}
+
+func (s *nfState) recordUnseen(p *notif) {
+	if !p.transient {
+		s.record(&journalEntry{Op: "unseen", Id: p.id})
+	}
+}
+
+func (s *nfState) recordSnooze(p *notif, until time.Time) {
+	if !p.transient {
+		s.record(&journalEntry{Op: "snooze", Id: p.id, Until: &until})
+	}
+}
+
+func (s *nfState) recordRemove(p *notif) {
+	if !p.transient {
+		s.record(&journalEntry{Op: "remove", Id: p.id})
+	}
+}
+
+// markSeen sets p.seen_by_user, recording it in the history.
+func (s *nfState) markSeen(p *notif) {
+	if !p.seen_by_user {
+		s.setSeen(p, true)
+		s.recordSeen(p)
+	}
+}
+
+// restoreHistory fills the notification list from the journal, dropping
+// notifications older than the retention period, then compacts it.
+// Restored notifications are treated as already closed, since the
+// applications that sent them were talking to a previous instance of the
+// server.
+func (s *nfState) restoreHistory() {
+	entries, err := s.history.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not read history:", err)
+		return
+	}
+
+	for _, e := range entries {
+		switch e.Op {
+		case "add", "replace":
+			el := s.findNotif(e.Id)
+			if el != nil {
+				s.moveToBack(el)
+			} else {
+				el = s.pushNotif(&notif{id: e.Id, closed: true})
+			}
+			p := el.Value.(*notif)
+			s.setAppName(p, e.AppName)
+			p.app_icon = e.AppIcon
+			p.actions = e.Actions
+			p.urgency = e.Urgency
+			p.category = e.Category
+			p.resident = e.Resident
+			p.expire_timeout = e.ExpireTimeout
+			s.setSeen(p, e.Seen)
+			// Queued again in case only the urgency changed
+			s.queueUnseen(el)
+			for _, t := range e.Text {
+				p.text = append(p.text, notiftext{t.Time, t.Summary, t.Body})
+			}
+		case "seen":
+			if el := s.findNotif(e.Id); el != nil {
+				s.setSeen(el.Value.(*notif), true)
+			}
+		case "unseen":
+			s.sched.Cancel(timerKey{e.Id, TimerSnooze})
+			if el := s.findNotif(e.Id); el != nil {
+				s.moveToBack(el)
+				s.setSeen(el.Value.(*notif), false)
+			}
+		case "snooze":
+			if s.findNotif(e.Id) != nil && e.Until != nil {
+				s.sched.Schedule(timerKey{e.Id, TimerSnooze}, *e.Until)
+			}
+		case "remove":
+			s.sched.Cancel(timerKey{e.Id, TimerSnooze})
+			if el := s.findNotif(e.Id); el != nil {
+				s.unlinkNotif(el)
+			}
+		case "clear":
+			s.sched.CancelAll(TimerSnooze)
+			s.clearNotifs()
+		}
+	}
+
+	cutoff := s.historyCutoff()
+	for id, el := range s.notifIndex {
+		p := el.Value.(*notif)
+		if len(p.text) == 0 || p.text[len(p.text)-1].time.Before(cutoff) {
+			s.sched.Cancel(timerKey{id, TimerSnooze})
+			s.unlinkNotif(el)
+			continue
+		}
+		if id >= s.notif_counter {
+			s.notif_counter = id + 1
+		}
+	}
+	s.applyLimits()
+	s.compactHistory()
+}
+
+// historyCutoff returns the time before which notifications are too old to be
+// kept in the history.
+func (s *nfState) historyCutoff() time.Time {
+	if s.history.retention <= 0 {
+		return time.Time{}
+	}
+	return s.clock.Now().Add(-s.history.retention)
+}
+
+// compactHistory rewrites the journal so that it only describes the
+// notifications in the list that are within the retention period.
+func (s *nfState) compactHistory() {
+	cutoff := s.historyCutoff()
+	var entries []*journalEntry
+	for e := s.notifList.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*notif)
+		if p.transient || p.text[len(p.text)-1].time.Before(cutoff) {
+			continue
+		}
+		entries = append(entries, notifEntry(p))
+		if at, ok := s.sched.Deadline(timerKey{p.id, TimerSnooze}); ok {
+			entries = append(entries,
+				&journalEntry{Op: "snooze", Id: p.id, Until: &at})
+		}
+	}
+	if err := s.history.rewrite(entries); err != nil {
+		fmt.Fprintln(os.Stderr, "could not compact history:", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	statuschange := make(chan *status, 1000)
+	signals := make(chan *dbusSignal, 1000)
+
+	conf := defaultConfig()
+	conf.History.Enabled = true
+	conf.History.File = path
+	conf.History.Retention.Duration = 0
+
+	clk := newFakeClock()
+	nfs := newNFState(statuschange, signals, conf, clk)
+
+	id1, _ := makeTestNotif(nfs, 0, "1", "0")
+	id2, _ := makeTestNotif(nfs, 0, "2", "0")
+	id3, _ := makeTestNotif(nfs, 0, "3", "0")
+	makeTestNotif(nfs, id1, "1", "1")
+	nfs.CloseNotif(id2)
+
+	restored := newNFState(statuschange, signals, conf, clk)
+	if restored.notifList.Len() != 2 {
+		t.Fatal("restored wrong number of notifications:",
+			restored.notifList.Len())
+	}
+	p3 := restored.notifList.Front().Value.(*notif)
+	p1 := restored.notifList.Back().Value.(*notif)
+	if p3.id != id3 || p1.id != id1 {
+		t.Error("notifications restored in the wrong order")
+	}
+	if len(p1.text) != 2 || p1.text[1].body != "1" {
+		t.Error("replacement text not restored")
+	}
+	if p3.seen_by_user || !p1.seen_by_user {
+		t.Error("seen state not restored")
+	}
+	if !p1.closed || !p3.closed {
+		t.Error("restored notifications should be closed")
+	}
+	if restored.notif_counter <= id3 {
+		t.Error("notif_counter not advanced past restored ids")
+	}
+
+	// Everything is older than the retention period, so it is all dropped
+	clk.Advance(time.Hour)
+	conf.History.Retention.Duration = time.Minute
+	expired := newNFState(statuschange, signals, conf, clk)
+	if expired.notifList.Len() != 0 {
+		t.Error("notifications older than the retention period were kept")
+	}
+}
+
+func TestSnoozeHistory(t *testing.T) {
+	statuschange := make(chan *status, 1000)
+	signals := make(chan *dbusSignal, 1000)
+
+	conf := defaultConfig()
+	conf.History.Enabled = true
+	conf.History.File = filepath.Join(t.TempDir(), "history.jsonl")
+
+	clk := newFakeClock()
+	nfs := newNFState(statuschange, signals, conf, clk)
+	id1, _ := makeTestNotif(nfs, 0, "1", "0")
+	id2, _ := makeTestNotif(nfs, 0, "2", "0")
+	if err := nfs.SnoozeNotif(id1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	advance(nfs, time.Minute)
+
+	restored := newNFState(statuschange, signals, conf, clk)
+	if restored.notifList.Len() != 2 {
+		t.Fatal("restored wrong number of notifications:",
+			restored.notifList.Len())
+	}
+	p2 := restored.notifList.Front().Value.(*notif)
+	p1 := restored.notifList.Back().Value.(*notif)
+	if p2.id != id2 || p1.id != id1 {
+		t.Error("woken notification not restored at the back")
+	}
+	if len(p1.text) != 1 {
+		t.Error("waking a notification added a message:", p1.text)
+	}
+	if p1.seen_by_user != nfs.findNotif(id1).Value.(*notif).seen_by_user {
+		t.Error("seen state of the woken notification not restored")
+	}
+	if _, ok := restored.sched.Deadline(timerKey{id1, TimerSnooze}); ok {
+		t.Error("woken notification is snoozed again after a restart")
+	}
+
+	// A notification snoozed during a restart still wakes up
+	if err := restored.SnoozeNotif(id2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// Restarting twice checks that compacting the journal keeps the snooze
+	newNFState(statuschange, signals, conf, clk)
+	again := newNFState(statuschange, signals, conf, clk)
+	if !again.findNotif(id2).Value.(*notif).seen_by_user {
+		t.Error("snoozed notification is unread after a restart")
+	}
+	if _, ok := again.sched.Deadline(timerKey{id2, TimerSnooze}); !ok {
+		t.Fatal("snooze not rescheduled after a restart")
+	}
+	advance(again, time.Minute)
+	if again.notifList.Back().Value.(*notif).id != id2 {
+		t.Error("snoozed notification did not wake up after a restart")
+	}
+}
+
+func TestSilentReplaceHistory(t *testing.T) {
+	statuschange := make(chan *status, 1000)
+	signals := make(chan *dbusSignal, 1000)
+
+	conf := defaultConfig()
+	conf.History.Enabled = true
+	conf.History.File = filepath.Join(t.TempDir(), "history.jsonl")
+	conf.Rules = []ruleConfig{{Summary: "quiet", Silent: true}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	clk := newFakeClock()
+	nfs := newNFState(statuschange, signals, conf, clk)
+	id1, _ := makeTestNotif(nfs, 0, "loud", "0")
+	nfs.HideNotif(id1)
+	makeTestNotif(nfs, id1, "quiet", "1")
+	if nfs.unreadCount() != 0 {
+		t.Fatal("silent replacement counts as unread")
+	}
+
+	restored := newNFState(statuschange, signals, conf, clk)
+	if restored.unreadCount() != 0 ||
+		!restored.findNotif(id1).Value.(*notif).seen_by_user {
+		t.Error("silent replacement is unread after a restart")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"container/list"
+)
+
+// evictionCandidate returns the notification that should make room among the
+// ones that match: the oldest that has been seen, then the oldest that hasn't
+// been seen.  The one being shown and keep are never picked.  It returns nil
+// if there is no other match.
+func (s *nfState) evictionCandidate(match func(p *notif) bool,
+	keep *list.Element) *list.Element {
+
+	var unseen *list.Element
+	for e := s.notifList.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*notif)
+		if e == s.currently_showing || e == keep || !match(p) {
+			continue
+		}
+		if p.seen_by_user {
+			return e
+		}
+		if unseen == nil {
+			unseen = e
+		}
+	}
+	return unseen
+}
+
+// enforceLimits closes and forgets notifications until there are no more
+// than the configured number overall and from each app, keeping the
+// notification at keep, which was just added.  The one being shown may go
+// over a limit, and is forgotten once it leaves the statusline.
+func (s *nfState) enforceLimits(keep *list.Element) {
+	if max := s.conf.Limits.PerApp; max > 0 {
+		for app, n := range s.appCounts {
+			for ; n > max; n-- {
+				e := s.evictionCandidate(func(p *notif) bool {
+					return p.app_name == app
+				}, keep)
+				if e == nil {
+					break
+				}
+				s.removeNotif(e, ReasonUndefined)
+			}
+		}
+	}
+	if max := s.conf.Limits.Notifications; max > 0 {
+		for s.notifList.Len() > max {
+			e := s.evictionCandidate(func(p *notif) bool { return true }, keep)
+			if e == nil {
+				break
+			}
+			s.removeNotif(e, ReasonUndefined)
+		}
+	}
+}
+
+// trimRevisions forgets the oldest messages of the notification at e beyond
+// the configured number, keeping seeking on the same message, or on the
+// oldest one left if its message was forgotten.
+func (s *nfState) trimRevisions(e *list.Element) {
+	max := s.conf.Limits.Revisions
+	p := e.Value.(*notif)
+	if max <= 0 || len(p.text) <= max {
+		return
+	}
+	drop := len(p.text) - max
+	p.text = append([]notiftext(nil), p.text[drop:]...)
+
+	if e == s.currently_showing && s.seeking_at >= 0 {
+		s.seeking_at -= drop
+		if s.seeking_at < 0 {
+			s.seeking_at = 0
+		}
+		s.updateStatus()
+	}
+}
+
+// applyLimits trims every notification to the configured limits, after they
+// may have changed.
+func (s *nfState) applyLimits() {
+	for e := s.notifList.Front(); e != nil; e = e.Next() {
+		s.trimRevisions(e)
+	}
+	s.enforceLimits(nil)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	conf := defaultConfig()
+	conf.Limits.Notifications = 3
+	nfs, _, signals := newTestState(conf)
+
+	expectEvicted := func(id uint32) {
+		if nfs.findNotif(id) != nil {
+			t.Errorf("%d was not evicted", id)
+		}
+		select {
+		case sig := <-signals:
+			if sig.name != "NotificationClosed" ||
+				sig.body[0] != id || sig.body[1] != uint32(ReasonUndefined) {
+				t.Errorf("expected %d to be closed, got %s %v", id, sig.name, sig.body)
+			}
+		default:
+			t.Errorf("no signal emitted for %d", id)
+		}
+	}
+
+	a1 := notifyApp(nfs, "a")
+	a2 := notifyApp(nfs, "a")
+	a3 := notifyApp(nfs, "a")
+	nfs.HideNotif(a3)
+
+	// The oldest seen notification goes first, but not the one being shown
+	a4 := notifyApp(nfs, "a")
+	expectEvicted(a3)
+	if showingId(nfs) != a1 {
+		t.Error("evicting changed the notification being shown")
+	}
+
+	// Then the oldest unseen one, but never the one being shown
+	notifyApp(nfs, "a")
+	expectEvicted(a2)
+	if showingId(nfs) != a1 {
+		t.Errorf("showing %d after an unseen notification was evicted", showingId(nfs))
+	}
+	if nfs.notifList.Len() != 3 || nfs.findNotif(a4) == nil {
+		t.Error("newer unseen notifications were evicted")
+	}
+
+	// Each app has its own limit, which doesn't evict the one being shown
+	// either
+	nfs.conf.Limits.PerApp = 1
+	nfs.applyLimits()
+	if nfs.notifList.Len() != 1 || nfs.appCounts["a"] != 1 {
+		t.Error("per app limit not applied:", nfs.appCounts)
+	}
+	if showingId(nfs) != a1 {
+		t.Error("per app limit evicted the notification being shown")
+	}
+	b1 := notifyApp(nfs, "b")
+	if nfs.notifList.Len() != 2 || nfs.findNotif(b1) == nil {
+		t.Error("another app's notification was evicted")
+	}
+	for len(signals) > 0 {
+		<-signals
+	}
+
+	// A new notification from the app being shown is kept, and the one being
+	// shown goes over the limit until it leaves the statusline
+	a6 := notifyApp(nfs, "a")
+	if nfs.findNotif(a6) == nil || nfs.findNotif(a1) == nil || len(signals) != 0 {
+		t.Error("new notification evicted to keep the one being shown")
+	}
+	nfs.HideNotif(a1)
+	expectEvicted(a1)
+	if nfs.findNotif(a6) == nil || nfs.appCounts["a"] != 1 {
+		t.Error("per app limit not applied after leaving the statusline")
+	}
+
+	// Seeking stays on the same message when older ones are forgotten
+	nfs.conf.Limits.Revisions = 2
+	nfs.DismissAll()
+	id1, _ := makeTestNotif(nfs, 0, "1", "0")
+	makeTestNotif(nfs, id1, "1", "1")
+	makeTestNotif(nfs, id1, "1", "2")
+	p := nfs.findNotif(id1).Value.(*notif)
+	if len(p.text) != 2 || p.text[0].body != "1" {
+		t.Error("old revisions not forgotten:", p.text)
+	}
+	nfs.SeekPrevMsg()
+	nfs.SeekNextMsg()
+	if nfs.seeking_at != 1 {
+		t.Fatal("not seeking at the latest message:", nfs.seeking_at)
+	}
+	makeTestNotif(nfs, id1, "1", "3")
+	if nfs.seeking_at != 0 || p.text[nfs.seeking_at].body != "2" {
+		t.Error("seeking moved to another message:", nfs.seeking_at)
+	}
+	makeTestNotif(nfs, id1, "1", "4")
+	if nfs.seeking_at != 0 || p.text[0].body != "3" {
+		t.Error("seeking at a forgotten message:", nfs.seeking_at)
+	}
+
+	conf.Limits.Revisions = -1
+	if conf.validate() == nil {
+		t.Error("negative limit passed validation")
+	}
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"container/list"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,12 +17,32 @@ type notiftext struct {
 	body    string
 }
 
+// The urgency levels given by the "urgency" hint.
+type urgency byte
+
+const (
+	UrgencyLow      urgency = 0
+	UrgencyNormal   urgency = 1
+	UrgencyCritical urgency = 2
+)
+
+// How long, in seconds, notifications that don't set their own timeout are
+// shown for, unless configured otherwise.
+const (
+	defaultLowTimeout    = 5
+	defaultNormalTimeout = 15
+)
+
 type notifEvent struct {
 	app_name       string
 	replaces_id    uint32
 	app_icon       string
 	text           notiftext
 	actions        []string
+	urgency        urgency
+	category       string
+	transient      bool
+	resident       bool
 	expire_timeout int32
 	id             chan uint32
 }
@@ -28,45 +53,95 @@ type notif struct {
 	app_icon       string
 	text           []notiftext
 	actions        []string
+	urgency        urgency
+	category       string
 	expire_timeout int32
 	seen_by_user   bool
+
+	// Transient notifications are removed from the list once they expire,
+	// instead of being kept around for seeking.
+	transient bool
+
+	// Resident notifications are not closed when one of their actions is
+	// invoked.
+	resident bool
+
+	// True once NotificationClosed has been emitted for this notification.
+	// A notification can stay in the list after it is closed (for example,
+	// when it expires) so that it can still be seeked to.
+	closed bool
+
+	// When the notification was last moved to the back of the list, and
+	// where it is queued in unseen and unseen_critical while it hasn't been
+	// seen.
+	list_seq    uint64
+	unseen_at   *list.Element
+	critical_at *list.Element
 }
 
-func notifExpireTimer(timeouts <-chan uint16, nextNotif chan<- bool) {
-	for {
-		select {
-		case waitTime := <-timeouts:
-			if waitTime > 0 {
-			Inner:
-				for {
-					select {
-					case waitTime = <-timeouts:
-						if waitTime == 0 {
-							break Inner
-						}
-					case <-time.After(time.Second * time.Duration(waitTime)):
-						nextNotif <- true
-						break Inner
-					}
-				}
-			}
+func (n *notif) displayString(separator string) string {
+	lastLine := n.text[len(n.text)-1]
+	return lastLine.summary + separator + lastLine.body
+}
+
+// actionLabels returns the labels of the notification's actions, formatted
+// for the statusline, or "" if it has no actions.
+func (n *notif) actionLabels() string {
+	l := ""
+	for i := 1; i < len(n.actions); i += 2 {
+		if n.actions[i] != "" {
+			l += " [" + n.actions[i] + "]"
 		}
 	}
+	return l
 }
 
-func (n *notif) displayString() string {
-	lastLine := n.text[len(n.text)-1]
-	return lastLine.summary + " | " + lastLine.body
+// actionList returns the key and label of each of the notification's
+// actions, in order.
+func (n *notif) actionList() []action {
+	var l []action
+	for i := 0; i+1 < len(n.actions); i += 2 {
+		l = append(l, action{n.actions[i], n.actions[i+1]})
+	}
+	return l
+}
+
+// hasAction returns true if key is one of the notification's action keys.
+func (n *notif) hasAction(key string) bool {
+	for i := 0; i < len(n.actions); i += 2 {
+		if n.actions[i] == key {
+			return true
+		}
+	}
+	return false
 }
 
 type nfState struct {
-	// If a notification's expiration should be canceled, 0 is passed through
-	// this channel.  If an expiration should be extended (because the
-	// notification is being replaced), the length of the extention is passed.
-	timeouts chan<- uint16
+	// Where the current time comes from.
+	clock clock
+
+	// Keeps the deadlines of expiring, snoozed and do not disturb.
+	sched *scheduler
+
+	// Scrolls the statusline, if the event loop is running.
+	marquee *time.Ticker
+
+	// The id of the notification whose expiry is scheduled, or 0 if none is.
+	expiring uint32
 
 	// The channel through which statusline updates are sent.
-	statuschange chan<- string
+	statuschange chan<- *status
+
+	// The channel through which D-Bus signals are sent.
+	signals chan<- *dbusSignal
+
+	// The on-disk history of notifications, or nil if it is disabled.
+	history *journal
+
+	conf *Config
+
+	// Reads the config again when it is reloaded.
+	loadConf func() (*Config, error)
 
 	// An incrementing counter that holds the id to be assigned to the next
 	// notification.
@@ -76,56 +151,297 @@ type nfState struct {
 	// or nil if no notifications are being shown.
 	currently_showing *list.Element
 
+	// The notification on the statusline as of the last update, so that a
+	// transient one can be removed once something else is shown.
+	last_shown *list.Element
+
 	// If the user is seeking through past notifications, this is the index of
 	// notif.text of the notification being displayed.  If the user is not
 	// seeking, this is -1. If currently_showing is nil, this must be -1.
 	seeking_at int
 
+	// How many seconds the notification being shown will be shown for, or 0
+	// if it stays until the user does something.
+	shown_for uint16
+
+	// The statusline last shown, before it was fitted to the display width.
+	shown_text string
+
+	// The statusline that is scrolling because it is too long to fit, how
+	// many graphemes it has been scrolled by, and how many graphemes long it
+	// is, or 0 if it is not scrolling.
+	marquee_text   string
+	marquee_offset int
+	marquee_length int
+
+	// Whether the user turned do not disturb on, and until when, or the zero
+	// time for until they turn it off.
+	dnd_on    bool
+	dnd_until time.Time
+
+	// If the user turned do not disturb off during quiet hours, when those
+	// quiet hours end.
+	dnd_off_until time.Time
+
+	// Whether do not disturb is on, as of the last time it was checked.
+	dnd_active bool
+
 	//  The list of notifications.
 	// We use a list instead of a slice because container/list gives functions
 	// very specific to this problem domain.  When a new notification replaces
-	// an old one, List.MoveToBack() is used.  List traversal is easily
+	// an old one, moveToBack() is used.  List traversal is easily
 	// accomplished by saving the position in currently_showing.
 	// The back of the list always contains the most recent notification. All
 	// elements are of type *notif.
 	notifList *list.List
-}
 
-func newNFState(statuschange chan<- string) (
-	*nfState,
-	<-chan uint16) {
+	// The element of every notification in notifList, by id.  It must be
+	// kept in sync with the list, so elements are only added and removed
+	// with pushNotif, unlinkNotif and clearNotifs.
+	notifIndex map[uint32]*list.Element
+
+	// How many notifications in notifList each app has.  App names are
+	// changed with setAppName to keep it in sync.
+	appCounts map[string]int
 
-	timeouts := make(chan uint16)
+	// The elements of the notifications in notifList that have not been
+	// seen, in the same order, and the critical ones among them, so that
+	// nextStatus never has to walk the notifications that have been seen.
+	// Elements are only moved to the back of notifList with moveToBack, and
+	// seen state is changed with setSeen, to keep them in sync.
+	unseen          *list.List
+	unseen_critical *list.List
+
+	// Counts up as notifications are moved to the back of notifList.
+	list_seq uint64
+}
 
-	return &nfState{
-		timeouts:          timeouts,
+func newNFState(statuschange chan<- *status, signals chan<- *dbusSignal,
+	conf *Config, clk clock) *nfState {
+
+	s := &nfState{
+		clock:             clk,
+		sched:             newScheduler(clk),
 		statuschange:      statuschange,
+		signals:           signals,
+		conf:              conf,
 		notif_counter:     1,
 		currently_showing: nil,
 		seeking_at:        -1,
 		notifList:         list.New(),
-	}, timeouts
+		notifIndex:        make(map[uint32]*list.Element),
+		appCounts:         make(map[string]int),
+		unseen:            list.New(),
+		unseen_critical:   list.New(),
+	}
+	if conf.History.Enabled {
+		s.history = newJournal(conf.History.File,
+			conf.History.Retention.Duration)
+		s.restoreHistory()
+	}
+	return s
 }
 
-func (s *nfState) updateStatus() {
-	_ = "breakpoint"
-	if s.currently_showing == nil {
-		s.statuschange <- ""
+// startExpiry starts counting down the seconds p is shown for, replacing any
+// other countdown.
+func (s *nfState) startExpiry(p *notif, secs uint16) {
+	s.cancelExpiry()
+	s.sched.After(timerKey{p.id, TimerExpire}, time.Duration(secs)*time.Second)
+	s.expiring = p.id
+}
+
+// cancelExpiry stops the countdown of the notification being shown, if
+// there is one.
+func (s *nfState) cancelExpiry() {
+	if s.expiring != 0 {
+		s.sched.Cancel(timerKey{s.expiring, TimerExpire})
+		s.expiring = 0
+	}
+}
+
+// HandleTimer acts on a deadline that has passed.
+func (s *nfState) HandleTimer(ev timerEvent) {
+	switch ev.key.purpose {
+	case TimerExpire:
+		if ev.key.id == s.expiring {
+			s.expiring = 0
+			s.ExpireCurrent()
+		}
+	case TimerSnooze:
+		s.WakeSnoozed(ev.key.id)
+	case TimerDND:
+		s.CheckDND()
+	}
+}
+
+// closeNotif emits the NotificationClosed signal for p, unless it has already
+// been emitted.
+func (s *nfState) closeNotif(p *notif, reason closeReason) {
+	if p.closed {
 		return
 	}
+	p.closed = true
+	s.signals <- &dbusSignal{
+		name: "NotificationClosed",
+		body: []interface{}{p.id, uint32(reason)},
+	}
+}
+
+// expireTimeout returns the number of seconds p should be shown on the
+// statusline for, or 0 if it should stay until the user or the application
+// removes it.
+func (s *nfState) expireTimeout(p *notif) uint16 {
+	if p.urgency == UrgencyCritical || p.expire_timeout == 0 {
+		return 0
+	}
+	if p.expire_timeout < 0 {
+		if p.urgency == UrgencyLow {
+			return uint16(s.conf.Timeouts.Low)
+		}
+		return uint16(s.conf.Timeouts.Normal)
+	}
+	// expire_timeout is given in milliseconds
+	secs := (int64(p.expire_timeout) + 999) / 1000
+	if secs > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(secs)
+}
+
+// shouldInterrupt returns true if a notification with the given urgency that
+// just arrived should be shown right away, instead of waiting for the
+// currently displayed one to expire.
+func (s *nfState) shouldInterrupt(u urgency) bool {
+	if s.currently_showing == nil {
+		return true
+	}
+	p := s.currently_showing.Value.(*notif)
+	if p.urgency == UrgencyCritical {
+		return false
+	}
+	return u == UrgencyCritical || s.expireTimeout(p) == 0
+}
+
+// unreadCount returns the number of notifications the user has not seen.
+func (s *nfState) unreadCount() int {
+	return s.unseen.Len()
+}
+
+// statusline renders the statusline of the notification being shown, before
+// it is fitted to the display width, and returns it with the fields it was
+// rendered from.
+func (s *nfState) statusline() (string, *templateFields) {
 	p := s.currently_showing.Value.(*notif)
-	var l string
 	var on_msg notiftext
+	f := &templateFields{
+		Id:        p.id,
+		AppName:   p.app_name,
+		AppIcon:   p.app_icon,
+		Urgency:   urgencyName(p.urgency),
+		Category:  p.category,
+		Revisions: len(p.text),
+		Unread:    s.unreadCount(),
+		Seeking:   s.seeking_at >= 0,
+		Separator: s.conf.Separator,
+	}
 	if s.seeking_at < 0 {
 		on_msg = p.text[len(p.text)-1]
-		l = ""
+		f.Revision = len(p.text)
 	} else {
 		on_msg = p.text[s.seeking_at]
-		l = "(" + Round(time.Since(on_msg.time), time.Second).String() + " ago) "
+		f.Revision = s.seeking_at + 1
+	}
+	f.Summary = on_msg.summary
+	f.Body = on_msg.body
+	f.Age = humanAge(on_msg.time, s.clock.Now())
+	if f.Revision == len(p.text) {
+		f.Actions = p.actionLabels()
+	}
+	return renderTemplate(s.conf.textTemplate(p.app_name), f), f
+}
+
+// RefreshAge redraws the statusline if the age of the message being shown
+// has changed what it says.
+func (s *nfState) RefreshAge() {
+	if s.currently_showing == nil {
+		return
+	}
+	if text, _ := s.statusline(); text != s.shown_text {
+		s.updateStatus()
+	}
+}
+
+func (s *nfState) updateStatus() {
+	if s.last_shown != s.currently_showing {
+		s.dropLastTransient()
+		// The notification that was shown may have been kept over a limit
+		s.enforceLimits(nil)
+	}
+	if s.currently_showing == nil {
+		s.marquee_length = 0
+		text := ""
+		if s.dnd_active {
+			text = s.dndIndicator()
+		}
+		s.statuschange <- &status{
+			text:       text,
+			seeking_at: -1,
+			unread:     s.unreadCount(),
+			dnd:        s.dnd_active,
+			conf:       s.conf,
+		}
+		return
+	}
+	p := s.currently_showing.Value.(*notif)
+	text, f := s.statusline()
+	s.shown_text = text
+	l := s.fitStatusline(text)
+	f.Text = l
+	s.statuschange <- &status{
+		text:       l,
+		id:         p.id,
+		app_name:   p.app_name,
+		summary:    f.Summary,
+		body:       f.Body,
+		urgency:    p.urgency,
+		messages:   append([]notiftext(nil), p.text...),
+		actions:    p.actionList(),
+		seeking_at: s.seeking_at,
+		revisions:  len(p.text),
+		unread:     f.Unread,
+		dnd:        s.dnd_active,
+		fields:     f,
+		conf:       s.conf,
 	}
+}
 
-	l += on_msg.summary + " | " + on_msg.body
-	s.statuschange <- l
+// dropLastTransient removes the notification that was on the statusline if
+// it is transient and something else is shown now, because it was hidden or
+// seeked past.  Transient notifications are never shown again once the user
+// moves them off the statusline; interrupt puts back the ones that are pushed
+// off by another notification.
+func (s *nfState) dropLastTransient() {
+	e := s.last_shown
+	s.last_shown = s.currently_showing
+	if e == nil || e == s.currently_showing {
+		return
+	}
+	if p := e.Value.(*notif); p.transient && s.findNotif(p.id) == e {
+		s.removeNotif(e, ReasonDismissed)
+	}
+}
+
+// interrupt shows a notification that should be shown right away in place of
+// the one being shown.  A transient notification pushed off this way is put
+// back to be shown again, since the user didn't act on it.
+func (s *nfState) interrupt() {
+	if e := s.currently_showing; e != nil && s.seeking_at < 0 {
+		if p := e.Value.(*notif); p.transient {
+			s.setSeen(p, false)
+			s.last_shown = nil
+		}
+	}
+	s.nextStatus(true)
 }
 
 func (s *nfState) nextStatus(isNewNotif bool) {
@@ -136,6 +452,20 @@ func (s *nfState) nextStatus(isNewNotif bool) {
 	}
 	s.seeking_at = -1
 
+	// While do not disturb is on, notifications that haven't been seen are
+	// not shown, except critical ones if they are allowed through.
+	if isNewNotif && (!s.dnd_active || s.conf.DND.AllowCritical) {
+		// Critical notifications jump ahead of all others, and stay on the
+		// statusline until they are hidden or dismissed.
+		if c := s.unseen_critical.Front(); c != nil {
+			s.cancelExpiry()
+			s.currently_showing = c.Value.(*list.Element)
+			s.shown_for = 0
+			s.updateStatus()
+			return
+		}
+	}
+
 	// After the following loop is over, this variable will be filled
 	// with the most recent permanent notification, if one exists.
 	var permanentNotif *notif = nil
@@ -145,29 +475,36 @@ func (s *nfState) nextStatus(isNewNotif bool) {
 	// ones).
 	nothingToShow := true
 
-	for e := s.notifList.Front(); e != nil; e = e.Next() {
+	// show puts the notification at e on the statusline, and returns true
+	// if it will expire.
+	show := func(e *list.Element) bool {
 		p := e.Value.(*notif)
-		if (!isNewNotif && e == s.currently_showing) ||
-			(isNewNotif && !p.seen_by_user) {
-
-			s.currently_showing = e
-
-			if p.expire_timeout == 0 {
-				if !p.seen_by_user {
-					permanentNotif = p
-				}
-			} else {
-				p.seen_by_user = true
-				if p.expire_timeout < 0 {
-					// TODO: replace this with a user-chosen value, or perhaps
-					// make it based on notification urgency
-					s.timeouts <- 15
-				} else {
-					s.timeouts <- uint16(p.expire_timeout)
-				}
+		s.currently_showing = e
 
-				s.updateStatus()
-				nothingToShow = false
+		timeout := s.expireTimeout(p)
+		s.shown_for = timeout
+		if timeout == 0 {
+			if !p.seen_by_user {
+				permanentNotif = p
+			}
+			return false
+		}
+		s.markSeen(p)
+		s.startExpiry(p, timeout)
+
+		s.updateStatus()
+		nothingToShow = false
+		return true
+	}
+
+	if !isNewNotif {
+		if s.currently_showing != nil {
+			show(s.currently_showing)
+		}
+	} else {
+		for u := s.unseen.Front(); u != nil; u = u.Next() {
+			e := u.Value.(*list.Element)
+			if (!s.dnd_active || e == s.currently_showing) && show(e) {
 				break
 			}
 		}
@@ -181,9 +518,42 @@ func (s *nfState) nextStatus(isNewNotif bool) {
 	}
 }
 
+// newId returns an unused notification id.
+func (s *nfState) newId() uint32 {
+	// Generate a new notification ID based on the counter, but make sure it
+	// isn't already being used by another notification.  If it is, keep
+	// incrementing the counter until an unused ID is found.
+	for s.notifIndex[s.notif_counter] != nil {
+		s.notif_counter++
+	}
+	id := s.notif_counter
+	s.notif_counter++
+	return id
+}
+
 func (s *nfState) HandleNotifEvent(n *notifEvent) {
 	id := n.replaces_id
 
+	rules := s.conf.applyRules(n)
+	if rules.drop {
+		// The application may be waiting for its notification to close.  If
+		// it replaces one, that one is closed too, since it can't be kept
+		// on the statusline after the application was told it closed.
+		if e := s.findNotif(id); id != 0 && e != nil {
+			s.removeNotif(e, ReasonUndefined)
+		} else {
+			if id == 0 {
+				id = s.newId()
+			}
+			s.signals <- &dbusSignal{
+				name: "NotificationClosed",
+				body: []interface{}{id, uint32(ReasonUndefined)},
+			}
+		}
+		n.id <- id
+		return
+	}
+
 	// If addNewNotif becomes true, it means a new entry must be added to the
 	// list of notifications, (instead of appending content to an already
 	// existing one).
@@ -193,97 +563,224 @@ func (s *nfState) HandleNotifEvent(n *notifEvent) {
 		addNewNotif = true
 		// Check if a notification with this id already exists in the
 		// list.
-		for e := s.notifList.Back(); e != nil; e = e.Prev() {
+		if e := s.findNotif(id); e != nil {
 			p := e.Value.(*notif)
-			if p.id == id {
-				// replace this notification with new properties, and
-				// append the new text
-				p.app_name = n.app_name
-				p.app_icon = n.app_icon
-				p.text = append(p.text, n.text)
-				p.actions = n.actions
-				p.expire_timeout = n.expire_timeout
-				p.seen_by_user = false
-				addNewNotif = false
-
-				if e == s.currently_showing {
-					s.nextStatus(false)
-				} else if s.currently_showing == nil ||
-					s.currently_showing.Value.(*notif).expire_timeout == 0 {
-
-					s.nextStatus(true)
-				}
-
-				s.notifList.MoveToBack(e)
-				break
+			// replace this notification with new properties, and
+			// append the new text
+			s.setAppName(p, n.app_name)
+			p.app_icon = n.app_icon
+			p.text = append(p.text, n.text)
+			p.actions = n.actions
+			p.urgency = n.urgency
+			p.category = n.category
+			p.transient = n.transient
+			p.resident = n.resident
+			p.expire_timeout = n.expire_timeout
+			p.closed = false
+			addNewNotif = false
+			s.trimRevisions(e)
+			s.moveToBack(e)
+
+			// Snoozed notifications stay hidden until they wake up
+			_, snoozed := s.sched.Deadline(timerKey{id, TimerSnooze})
+			s.setSeen(p, rules.silent || snoozed)
+			s.recordReplace(p)
+
+			if e == s.currently_showing {
+				s.nextStatus(false)
+			} else if !p.seen_by_user && s.shouldInterrupt(p.urgency) {
+				s.interrupt()
+			}
+			if rules.markSeen {
+				s.markSeen(p)
 			}
 		}
 	} else {
-		// Generate a new notification ID based on the counter, but
-		// make sure it isn't already being used by another
-		// notification.  If it is, keep incrementing the counter until
-		// an unused ID is found.
 		addNewNotif = true
-	Outer:
-		for {
-			for e := s.notifList.Front(); e != nil; e = e.Next() {
-				p := e.Value.(*notif)
-				if p.id == s.notif_counter {
-					s.notif_counter++
-					continue Outer
-				}
-			}
-			break
-		}
-		id = s.notif_counter
-		s.notif_counter++
+		id = s.newId()
 	}
 
 	// Add a new notification to the list
 	if addNewNotif {
-		s.notifList.PushBack(&notif{
+		p := &notif{
 			id:             id,
 			app_name:       n.app_name,
+			app_icon:       n.app_icon,
 			text:           []notiftext{n.text},
 			actions:        n.actions,
+			urgency:        n.urgency,
+			category:       n.category,
+			transient:      n.transient,
+			resident:       n.resident,
 			expire_timeout: n.expire_timeout,
-		})
+			seen_by_user:   rules.silent,
+		}
+		s.pushNotif(p)
+		s.recordAdd(p)
 
 		// The statusline should only be updated if it's not showing anything
 		// currently (because if it is, the new content will eventually be shown
 		// after timeouts expire).  But if a permanent notification is being
 		// shown, the new notification should be displayed now because it will
-		// never timeout.
-		if s.currently_showing == nil ||
-			s.currently_showing.Value.(*notif).expire_timeout == 0 {
-
-			s.nextStatus(true)
+		// never timeout.  Critical notifications are always shown right away,
+		// unless another critical notification is already being shown.
+		// Silent notifications are already seen, so they are never shown.
+		if !rules.silent && s.shouldInterrupt(n.urgency) {
+			s.interrupt()
+		}
+		if rules.markSeen {
+			s.markSeen(p)
 		}
 	}
+	s.enforceLimits(s.findNotif(id))
+
 	// Tell dbus what ID we chose for this notification
 	n.id <- id
 }
 
-func (s *nfState) HideNotif(id uint32) {
-	var toHide *notif = nil
+// findNotif returns the element of the notification with the given id, or
+// nil if there is none.
+func (s *nfState) findNotif(id uint32) *list.Element {
+	return s.notifIndex[id]
+}
 
-	if s.currently_showing.Value.(*notif).id == id {
-		toHide = s.currently_showing.Value.(*notif)
+// pushNotif adds p to the back of the list.
+func (s *nfState) pushNotif(p *notif) *list.Element {
+	e := s.notifList.PushBack(p)
+	s.notifIndex[p.id] = e
+	s.appCounts[p.app_name]++
+	s.list_seq++
+	p.list_seq = s.list_seq
+	s.queueUnseen(e)
+	return e
+}
 
-		if s.seeking_at <= 0 {
-			s.timeouts <- 0
-			defer s.nextStatus(true)
-		}
-	} else {
-		for e := s.notifList.Front(); e != nil; e = e.Next() {
-			if e.Value.(*notif).id == id {
-				toHide = e.Value.(*notif)
-				break
-			}
+// moveToBack moves the notification at e to the back of the list, making it
+// the most recent one.
+func (s *nfState) moveToBack(e *list.Element) {
+	s.notifList.MoveToBack(e)
+	s.list_seq++
+	e.Value.(*notif).list_seq = s.list_seq
+	s.queueUnseen(e)
+}
+
+// unlinkNotif takes the notification at e out of the list, without closing
+// it or touching the statusline.
+func (s *nfState) unlinkNotif(e *list.Element) {
+	p := e.Value.(*notif)
+	delete(s.notifIndex, p.id)
+	s.countApp(p.app_name, -1)
+	s.unqueueUnseen(p)
+	s.notifList.Remove(e)
+}
+
+// clearNotifs empties the list.
+func (s *nfState) clearNotifs() {
+	s.notifList.Init()
+	s.notifIndex = make(map[uint32]*list.Element)
+	s.appCounts = make(map[string]int)
+	s.unseen = list.New()
+	s.unseen_critical = list.New()
+}
+
+// setAppName changes the app that p, which is in the list, is from.
+func (s *nfState) setAppName(p *notif, app_name string) {
+	s.countApp(p.app_name, -1)
+	s.countApp(app_name, 1)
+	p.app_name = app_name
+}
+
+// setSeen changes whether p has been seen, queueing it in unseen if it is in
+// the list.
+func (s *nfState) setSeen(p *notif, seen bool) {
+	if p.seen_by_user == seen {
+		return
+	}
+	p.seen_by_user = seen
+	if e := s.findNotif(p.id); e != nil && e.Value == p {
+		s.queueUnseen(e)
+	}
+}
+
+// queueUnseen files the notification at e in unseen, and in unseen_critical
+// if it is critical, when it hasn't been seen.
+func (s *nfState) queueUnseen(e *list.Element) {
+	p := e.Value.(*notif)
+	s.unqueueUnseen(p)
+	if p.seen_by_user {
+		return
+	}
+	p.unseen_at = insertQueued(s.unseen, e)
+	if p.urgency == UrgencyCritical {
+		p.critical_at = insertQueued(s.unseen_critical, e)
+	}
+}
+
+func (s *nfState) unqueueUnseen(p *notif) {
+	if p.unseen_at != nil {
+		s.unseen.Remove(p.unseen_at)
+		p.unseen_at = nil
+	}
+	if p.critical_at != nil {
+		s.unseen_critical.Remove(p.critical_at)
+		p.critical_at = nil
+	}
+}
+
+// insertQueued adds the notification at e to q, after the ones that were
+// moved to the back of the list before it.  That is almost always the back
+// of q, so it seldom has to look far.
+func insertQueued(q *list.List, e *list.Element) *list.Element {
+	seq := e.Value.(*notif).list_seq
+	at := q.Back()
+	for at != nil && at.Value.(*list.Element).Value.(*notif).list_seq > seq {
+		at = at.Prev()
+	}
+	if at == nil {
+		return q.PushFront(e)
+	}
+	return q.InsertAfter(e, at)
+}
+
+func (s *nfState) countApp(app_name string, n int) {
+	s.appCounts[app_name] += n
+	if s.appCounts[app_name] == 0 {
+		delete(s.appCounts, app_name)
+	}
+}
+
+func noSuchNotif(id uint32) error {
+	return fmt.Errorf("no notification with id %d", id)
+}
+
+func (s *nfState) HideNotif(id uint32) error {
+	e := s.findNotif(id)
+	if e == nil {
+		return noSuchNotif(id)
+	}
+
+	if e == s.currently_showing && s.seeking_at <= 0 {
+		s.cancelExpiry()
+		defer s.nextStatus(true)
+	}
+
+	s.markSeen(e.Value.(*notif))
+	return nil
+}
+
+// HideApp hides every notification sent by the given application.
+func (s *nfState) HideApp(app_name string) {
+	for e := s.notifList.Front(); e != nil; e = e.Next() {
+		if p := e.Value.(*notif); p.app_name == app_name {
+			s.markSeen(p)
 		}
 	}
+	if s.currently_showing != nil && s.seeking_at < 0 &&
+		s.currently_showing.Value.(*notif).app_name == app_name {
 
-	toHide.seen_by_user = true
+		s.cancelExpiry()
+		s.nextStatus(true)
+	}
 }
 
 func (s *nfState) HideAllNotifs() {
@@ -292,10 +789,10 @@ func (s *nfState) HideAllNotifs() {
 	}
 
 	for e := s.notifList.Front(); e != nil; e = e.Next() {
-		e.Value.(*notif).seen_by_user = true
+		s.markSeen(e.Value.(*notif))
 	}
 
-	s.timeouts <- 0
+	s.cancelExpiry()
 	s.seeking_at = -1
 	s.currently_showing = nil
 }
@@ -304,30 +801,138 @@ func (s *nfState) DismissCurrent() {
 	if s.currently_showing == nil {
 		return
 	}
-	if s.seeking_at <= 0 {
-		s.timeouts <- 0
-		defer s.updateStatus()
+	s.removeNotif(s.currently_showing, ReasonDismissed)
+}
+
+// removeNotif closes the notification at e with the given reason and removes
+// it from the list, moving the statusline on if it was being shown.
+func (s *nfState) removeNotif(e *list.Element, reason closeReason) {
+	p := e.Value.(*notif)
+	s.closeNotif(p, reason)
+	s.sched.Cancel(timerKey{p.id, TimerSnooze})
+	defer s.recordRemove(p)
+
+	if e != s.currently_showing {
+		s.unlinkNotif(e)
+		return
 	}
 
-	toRemove := s.currently_showing
-	s.currently_showing = s.currently_showing.Next()
-	s.notifList.Remove(toRemove)
+	if s.seeking_at < 0 {
+		// Not seeking, so move on to the next unseen notification.
+		s.cancelExpiry()
+		s.currently_showing = nil
+		s.unlinkNotif(e)
+		s.nextStatus(true)
+		return
+	}
 
-	if s.seeking_at > 0 {
-		if s.currently_showing != nil {
-			s.seeking_at = len(s.currently_showing.Value.(*notif).text) - 1
-			s.updateStatus()
-		} else {
-			s.seeking_at = -1
-			s.nextStatus(true)
+	s.currently_showing = e.Next()
+	s.unlinkNotif(e)
+
+	if s.currently_showing != nil {
+		s.seeking_at = len(s.currently_showing.Value.(*notif).text) - 1
+		s.updateStatus()
+	} else {
+		s.seeking_at = -1
+		s.nextStatus(true)
+	}
+}
+
+// DismissNotif removes the notification with the given id.
+func (s *nfState) DismissNotif(id uint32) error {
+	e := s.findNotif(id)
+	if e == nil {
+		return noSuchNotif(id)
+	}
+	s.removeNotif(e, ReasonDismissed)
+	return nil
+}
+
+// DismissApp removes every notification sent by the given application.
+func (s *nfState) DismissApp(app_name string) {
+	for e := s.notifList.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*notif).app_name == app_name {
+			s.removeNotif(e, ReasonDismissed)
+		}
+		e = next
+	}
+}
+
+// CloseNotif removes the notification with the given id, as requested by the
+// application that sent it.
+func (s *nfState) CloseNotif(id uint32) {
+	if e := s.findNotif(id); e != nil {
+		s.removeNotif(e, ReasonClosed)
+	}
+}
+
+// GotoNotif starts seeking at the latest message of the notification with
+// the given id.
+func (s *nfState) GotoNotif(id uint32) error {
+	e := s.findNotif(id)
+	if e == nil {
+		return noSuchNotif(id)
+	}
+	if s.seeking_at < 0 {
+		s.cancelExpiry()
+	}
+	s.currently_showing = e
+	s.seeking_at = len(e.Value.(*notif).text) - 1
+	s.updateStatus()
+	return nil
+}
+
+// InvokeAction emits ActionInvoked for the given action of the notification
+// with the given id, then closes it unless it is resident.  If id is 0, the
+// notification currently being displayed is used.
+func (s *nfState) InvokeAction(id uint32, key string) error {
+	e := s.currently_showing
+	if id != 0 {
+		e = s.findNotif(id)
+		if e == nil {
+			return noSuchNotif(id)
 		}
+	} else if e == nil {
+		return errNothingShown
+	}
+
+	p := e.Value.(*notif)
+	if !p.hasAction(key) {
+		return fmt.Errorf("notification %d has no action %q", p.id, key)
+	}
+	s.signals <- &dbusSignal{
+		name: "ActionInvoked",
+		body: []interface{}{p.id, key},
+	}
+	if !p.resident {
+		s.removeNotif(e, ReasonDismissed)
 	}
+	return nil
+}
+
+// ExpireCurrent is called when the timeout of the notification being
+// displayed runs out.
+func (s *nfState) ExpireCurrent() {
+	if s.currently_showing != nil && s.seeking_at < 0 {
+		if s.currently_showing.Value.(*notif).transient {
+			s.removeNotif(s.currently_showing, ReasonExpired)
+			return
+		}
+		s.closeNotif(s.currently_showing.Value.(*notif), ReasonExpired)
+	}
+	s.nextStatus(true)
 }
 
 func (s *nfState) DismissAll() {
-	s.notifList = list.New()
+	for e := s.notifList.Front(); e != nil; e = e.Next() {
+		s.closeNotif(e.Value.(*notif), ReasonDismissed)
+	}
+	s.clearNotifs()
+	s.sched.CancelAll(TimerSnooze)
+	s.record(&journalEntry{Op: "clear"})
 	s.seeking_at = -1
-	s.timeouts <- 0
+	s.cancelExpiry()
 	s.nextStatus(true)
 }
 
@@ -353,7 +958,7 @@ func (s *nfState) SeekNextMsg() {
 
 func (s *nfState) SeekPrevMsg() {
 	if s.seeking_at < 0 {
-		s.timeouts <- 0
+		s.cancelExpiry()
 		if s.currently_showing != nil {
 			s.seeking_at = len(s.currently_showing.Value.(*notif).text) - 1
 		} else {
@@ -410,12 +1015,177 @@ func (s *nfState) SeekPrevNotif() {
 	s.updateStatus()
 }
 
-func WatchEvents(eh *eventHandler, statuschange chan<- string,
-	remote <-chan RemoteButton) {
+// ReloadConfig replaces the config with the one returned by s.loadConf, and
+// redraws the statusline with it.  If loading fails, the old config is kept.
+func (s *nfState) ReloadConfig() error {
+	conf, err := s.loadConf()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "not reloading config:", err)
+		return err
+	}
+	for _, key := range conf.keepStartupSettings(s.conf) {
+		fmt.Fprintln(os.Stderr, key, "changed; restart to apply it")
+	}
+	if s.history != nil {
+		s.history.retention = conf.History.Retention.Duration
+	}
+	s.conf = conf
+	s.applyLimits()
+	if s.marquee != nil {
+		s.marquee.Reset(conf.Display.ScrollInterval.Duration)
+	}
+	// The quiet hours may have changed
+	s.CheckDND()
+	s.updateStatus()
+	return nil
+}
+
+// errNothingShown is returned by commands that act on the notification being
+// shown when there isn't one.
+var errNothingShown = errors.New("no notification is being shown")
+
+// RunCommand carries out a command sent by a remote client.  Queries also
+// return their result.
+func (s *nfState) RunCommand(cmd *remoteCommand) (queryResult, error) {
+	switch cmd.button {
+	case List:
+		return s.listNotifs(), nil
+	case Show:
+		id, err := idArg(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return s.showNotif(id)
+	case History:
+		n := defaultHistoryCount
+		if len(cmd.args) == 1 {
+			var err error
+			n, err = strconv.Atoi(cmd.args[0])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad count %q", cmd.args[0])
+			}
+		} else if len(cmd.args) > 1 {
+			return nil, errors.New("usage: history [n]")
+		}
+		return s.messageHistory(n), nil
+	case Count:
+		return s.countNotifs(), nil
+	case Hide:
+		if len(cmd.args) == 0 {
+			if s.currently_showing == nil {
+				return nil, errNothingShown
+			}
+			return nil, s.HideNotif(s.currently_showing.Value.(*notif).id)
+		}
+		id, err := idArg(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.HideNotif(id)
+	case Dismiss:
+		if len(cmd.args) == 0 {
+			s.DismissCurrent()
+			return nil, nil
+		}
+		id, err := idArg(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.DismissNotif(id)
+	case Goto:
+		id, err := idArg(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.GotoNotif(id)
+	case HideApp, DismissApp:
+		if len(cmd.args) == 0 {
+			return nil, fmt.Errorf("usage: %s <app_name>", cmd.button)
+		}
+		// Application names can contain spaces
+		app_name := strings.Join(cmd.args, " ")
+		if cmd.button == HideApp {
+			s.HideApp(app_name)
+		} else {
+			s.DismissApp(app_name)
+		}
+	case HideAll:
+		s.HideAllNotifs()
+	case DismissAll:
+		s.DismissAll()
+	case NextMsg:
+		s.SeekNextMsg()
+	case PrevMsg:
+		s.SeekPrevMsg()
+	case NextNotif:
+		s.SeekNextNotif()
+	case PrevNotif:
+		s.SeekPrevNotif()
+	case Reload:
+		return nil, s.ReloadConfig()
+	case Snooze:
+		id := uint32(0)
+		switch len(cmd.args) {
+		case 1:
+			if s.currently_showing == nil {
+				return nil, errNothingShown
+			}
+			id = s.currently_showing.Value.(*notif).id
+		case 2:
+			var err error
+			if id, err = parseId(cmd.args[0]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("usage: snooze [id] <duration>")
+		}
+		d, err := time.ParseDuration(cmd.args[len(cmd.args)-1])
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.SnoozeNotif(id, d)
+	case Dnd:
+		if len(cmd.args) == 0 {
+			return s.dndState(), nil
+		}
+		return nil, s.SetDND(cmd.args)
+	case DryRun:
+		return s.conf.dryRun(cmd.args)
+	case Invoke:
+		if len(cmd.args) == 1 {
+			return nil, s.InvokeAction(0, cmd.args[0])
+		} else if len(cmd.args) == 2 {
+			id, err := parseId(cmd.args[0])
+			if err != nil {
+				return nil, err
+			}
+			return nil, s.InvokeAction(id, cmd.args[1])
+		}
+		return nil, errors.New("usage: invoke [id] <action>")
+	default:
+		return nil, fmt.Errorf("unknown command %q", cmd.button)
+	}
+	return nil, nil
+}
+
+func WatchEvents(eh *eventHandler, statuschange chan<- *status,
+	remote <-chan *remoteCommand, conf *Config,
+	reload <-chan os.Signal, loadConf func() (*Config, error)) {
 
-	nfs, timeouts := newNFState(statuschange)
-	nextNotif := make(chan bool)
-	go notifExpireTimer(timeouts, nextNotif)
+	nfs := newNFState(statuschange, eh.signals, conf, eh.clock)
+	nfs.loadConf = loadConf
+
+	nfs.marquee = time.NewTicker(conf.Display.ScrollInterval.Duration)
+	defer nfs.marquee.Stop()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	// Show anything restored from the history that hasn't been seen yet
+	nfs.dnd_active = nfs.dndActive(nfs.clock.Now())
+	nfs.scheduleDND()
+	if nfs.notifList.Len() > 0 || nfs.dnd_active {
+		nfs.nextStatus(true)
+	}
 
 	for {
 		select {
@@ -424,29 +1194,25 @@ func WatchEvents(eh *eventHandler, statuschange chan<- string,
 			nfs.HandleNotifEvent(n)
 
 		case c := <-eh.close:
-			nfs.HideNotif(c)
-
-		case isNewNotif := <-nextNotif:
-			nfs.nextStatus(isNewNotif)
-
-		case button := <-remote:
-			if button == Hide {
-				nfs.HideNotif(nfs.currently_showing.Value.(*notif).id)
-			} else if button == HideAll {
-				nfs.HideAllNotifs()
-			} else if button == Dismiss {
-				nfs.DismissCurrent()
-			} else if button == DismissAll {
-				nfs.DismissAll()
-			} else if button == NextMsg {
-				nfs.SeekNextMsg()
-			} else if button == PrevMsg {
-				nfs.SeekPrevMsg()
-			} else if button == NextNotif {
-				nfs.SeekNextNotif()
-			} else if button == PrevNotif {
-				nfs.SeekPrevNotif()
+			nfs.CloseNotif(c)
+
+		case <-nfs.sched.C():
+			for _, ev := range nfs.sched.Expired() {
+				nfs.HandleTimer(ev)
 			}
+
+		case <-nfs.marquee.C:
+			nfs.ScrollMarquee()
+
+		case <-tick.C:
+			nfs.RefreshAge()
+
+		case <-reload:
+			nfs.ReloadConfig()
+
+		case cmd := <-remote:
+			result, err := nfs.RunCommand(cmd)
+			cmd.reply <- &commandReply{result, err}
 		}
 	}
 }
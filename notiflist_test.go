@@ -1,61 +1,112 @@
 package main
 
 import (
+	"container/list"
+	"strings"
 	"testing"
 	"time"
 )
 
-func makeTestNotif(nfs *nfState, timeoutchan <-chan uint16, id uint32, s, b string) (uint32, uint16) {
-	getId := make(chan uint32)
-	go func(g chan uint32) {
-		nfs.HandleNotifEvent(&notifEvent{
-			app_name:    "test",
-			replaces_id: id,
-			app_icon:    "",
-			text: notiftext{
-				time:    time.Now(),
-				summary: s,
-				body:    b,
-			},
-			actions:        []string{},
-			expire_timeout: -1,
-			id:             g,
-		})
-	}(getId)
+// makeTestNotif sends a notification that replaces id, or a new one if id is
+// 0, a second after the last one.  It returns the id the notification was
+// given, and the seconds of the expiry countdown it started, or 0 if it didn't
+// start one.
+func makeTestNotif(nfs *nfState, id uint32, s, b string) (uint32, uint16) {
+	nfs.clock.(*fakeClock).Advance(time.Second)
+	expiring := nfs.expiring
+	before, _ := nfs.sched.Deadline(timerKey{expiring, TimerExpire})
 
-	var ret uint32
-	gotId := false
-	var timeout uint16 = 0
-	gotTimeout := false
+	getId := make(chan uint32, 1)
+	nfs.HandleNotifEvent(&notifEvent{
+		app_name:    "test",
+		replaces_id: id,
+		app_icon:    "",
+		text: notiftext{
+			time:    nfs.clock.Now(),
+			summary: s,
+			body:    b,
+		},
+		actions:        []string{},
+		expire_timeout: -1,
+		id:             getId,
+	})
 
-	for !(gotId && (gotTimeout || timeoutchan == nil)) {
+	after, ok := nfs.sched.Deadline(timerKey{nfs.expiring, TimerExpire})
+	if !ok || (nfs.expiring == expiring && after.Equal(before)) {
+		return <-getId, 0
+	}
+	return <-getId, expirySecs(nfs)
+}
+
+// expirySecs returns the seconds left until the notification being shown
+// expires, or 0 if it doesn't.
+func expirySecs(nfs *nfState) uint16 {
+	at, ok := nfs.sched.Deadline(timerKey{nfs.expiring, TimerExpire})
+	if !ok {
+		return 0
+	}
+	return uint16(Round(at.Sub(nfs.clock.Now()), time.Second) / time.Second)
+}
+
+// advance moves the clock of nfs forward, and handles the deadlines that
+// passed the way the event loop does.
+func advance(nfs *nfState, d time.Duration) {
+	nfs.clock.(*fakeClock).Advance(d)
+	for {
 		select {
-		case ret = <-getId:
-			gotId = true
-		case timeout = <-timeoutchan:
-			gotTimeout = true
+		case <-nfs.sched.C():
+			for _, ev := range nfs.sched.Expired() {
+				nfs.HandleTimer(ev)
+			}
+		default:
+			return
 		}
 	}
+}
 
-	select {
-	case timeout = <-timeoutchan:
-	default:
-	}
+// newTestState returns an nfState with a fake clock, and the channels it
+// sends status updates and signals on.
+func newTestState(conf *Config) (*nfState, chan *status, chan *dbusSignal) {
+	statuschange := make(chan *status, 1000)
+	signals := make(chan *dbusSignal, 1000)
+	return newNFState(statuschange, signals, conf, newFakeClock()),
+		statuschange, signals
+}
 
-	return ret, timeout
+// notifyApp sends a new notification from app_name, with the app name as its
+// summary, and returns its id.
+func notifyApp(nfs *nfState, app_name string) uint32 {
+	id := make(chan uint32, 1)
+	nfs.HandleNotifEvent(&notifEvent{
+		app_name:       app_name,
+		text:           notiftext{time: nfs.clock.Now(), summary: app_name},
+		expire_timeout: -1,
+		id:             id,
+	})
+	return <-id
+}
+
+// showingId returns the id of the notification being shown, or 0 if nothing
+// is.
+func showingId(nfs *nfState) uint32 {
+	if nfs.currently_showing == nil {
+		return 0
+	}
+	return nfs.currently_showing.Value.(*notif).id
 }
 
 func TestNotifList(t *testing.T) {
-	statuschange := make(chan string, 1000)
+	statuschange := make(chan *status, 1000)
+	signals := make(chan *dbusSignal, 1000)
 
-	nfs, timeouts := newNFState(statuschange)
+	nfs := newNFState(statuschange, signals, defaultConfig(), newFakeClock())
 	if nfs.notifList.Len() != 0 {
 		t.Error("bad number of elements in notifList")
 	}
 
 	// Add the first notification
-	id1, waitTime1 := makeTestNotif(nfs, timeouts, 0, "1", "0")
-	t.Logf("n1 has id %f and timeout %f", id1, waitTime1)
+	id1, waitTime1 := makeTestNotif(nfs, 0, "1", "0")
+	t.Logf("n1 has id %d and timeout %d", id1, waitTime1)
 	if id1 == 0 {
 		t.Error("notif was assigned a zero id")
 	}
@@ -87,8 +138,8 @@ func TestNotifList(t *testing.T) {
 	}
 
 	// Add the second notification
-	id2, waitTime2 := makeTestNotif(nfs, nil, 0, "2", "0")
-	t.Logf("n2 has id %f and timeout %f", id2, waitTime2)
+	id2, waitTime2 := makeTestNotif(nfs, 0, "2", "0")
+	t.Logf("n2 has id %d and timeout %d", id2, waitTime2)
 	// second notification should not have returned a timeout, indicated by 0
 	if waitTime2 != 0 {
 		t.Error("n2 should not have timed out")
@@ -100,7 +151,7 @@ func TestNotifList(t *testing.T) {
 		t.Error("first 2 notifications were given the same id:", id1)
 	}
 
-	t.Logf("n2 has id %f and timeout %f", id2, waitTime2)
+	t.Logf("n2 has id %d and timeout %d", id2, waitTime2)
 
 	if nfs.seeking_at >= 0 {
 		t.Error("seeking when it's not supposed to!")
@@ -130,12 +181,12 @@ func TestNotifList(t *testing.T) {
 
 	// Update the second notification, which should not affect the currently
 	// displayed notification
-	id2_1, waitTime2_1 := makeTestNotif(nfs, nil, id2, "2", "1")
+	id2_1, waitTime2_1 := makeTestNotif(nfs, id2, "2", "1")
 	if waitTime2_1 != 0 {
 		t.Error("n2.1 should not have timed out")
 	}
 	if id2_1 != id2 {
-		t.Errorf("n2.1 was given id %f but expected %f", id2_1, id2)
+		t.Errorf("n2.1 was given id %d but expected %d", id2_1, id2)
 	}
 	if nfs.notifList.Len() != 2 {
 		t.Error("bad number of elements in notifList")
@@ -151,9 +202,9 @@ func TestNotifList(t *testing.T) {
 	}
 
 	// Update the first notification, which should affect the display
-	id1_1, waitTime1_1 := makeTestNotif(nfs, timeouts, id1, "1", "1")
+	id1_1, waitTime1_1 := makeTestNotif(nfs, id1, "1", "1")
 	if id1_1 != id1 {
-		t.Errorf("n1.1 was given id %f but expected %f", id1_1, id1)
+		t.Errorf("n1.1 was given id %d but expected %d", id1_1, id1)
 	}
 	if waitTime1_1 == 0 {
 		t.Error("n1.1 should have reset the timer but did not")
@@ -177,18 +228,10 @@ func TestNotifList(t *testing.T) {
 
 	// Timeouts expire, statusline should shift to now show n2
 	// We should expect a new timeout counter
-	go func(timeouts <-chan uint16) {
-		select {
-		case waitTime2_2 := <-timeouts:
-			if waitTime2_2 == 0 {
-				t.Error("n2's timeout was 0 when it should be >0")
-			}
-		case <-time.After(time.Second):
-			t.Error("n2 never sent a timeout")
-		}
-	}(timeouts)
-
 	nfs.nextStatus(true)
+	if expirySecs(nfs) == 0 {
+		t.Error("n2's timeout was 0 when it should be >0")
+	}
 
 	if nfs.currently_showing == nfs.notifList.Back() {
 		t.Error("currently_showing points to the wrong notif")
@@ -197,18 +240,19 @@ func TestNotifList(t *testing.T) {
 		t.Error("bad number of elements in notifList")
 	}
 	if nfs.currently_showing.Value.(*notif).id != id2 {
-		t.Errorf("currently_showing has id %f but expected n2.id %f",
+		t.Errorf("currently_showing has id %d but expected n2.id %d",
 			nfs.currently_showing.Value.(*notif).id, id2)
 	}
 	if nfs.seeking_at != -1 {
 		t.Error("seeking at the wrong time!")
 	}
 
-	// test seeking: first, PrevMsg and PrevNotif, which should both do nothing
-	// in this case because n2 is at the front of the list
+	// test seeking: n2 has two messages, so PrevMsg starts seeking and steps
+	// back from the latest one to the first, n2.0.  It doesn't move to
+	// another notification, because n2 is at the front of the list.
 	nfs.SeekPrevMsg()
 
-	// same tests as above, because nothing should have changed
+	// same tests as above, except that we are now seeking at n2.0
 	if nfs.currently_showing == nfs.notifList.Back() {
 		t.Error("currently_showing points to the wrong notif")
 	}
@@ -216,15 +260,15 @@ func TestNotifList(t *testing.T) {
 		t.Error("bad number of elements in notifList")
 	}
 	if nfs.currently_showing.Value.(*notif).id != id2 {
-		t.Errorf("currently_showing has id %f but expected n2.id %f",
+		t.Errorf("currently_showing has id %d but expected n2.id %d",
 			nfs.currently_showing.Value.(*notif).id, id2)
 	}
-	if nfs.seeking_at != -1 {
+	if nfs.seeking_at != 0 {
 		t.Error("seeking at the wrong time!")
 	}
 
-	// add a new notification, n3
-	id3, waitTime3 := makeTestNotif(nfs, nil, 0, "3", "0")
+	// add a new notification, n3, which should not interrupt seeking
+	id3, waitTime3 := makeTestNotif(nfs, 0, "3", "0")
 	if id3 == 0 || id3 == id1 || id3 == id2 {
 		t.Error("n3 was given bad id ", id3)
 	}
@@ -232,18 +276,578 @@ func TestNotifList(t *testing.T) {
 		t.Error("n3 was given a timeout when it shouldn't have")
 	}
 	if nfs.notifList.Len() != 3 {
-		t.Errorf("bad number of elements in notifList: expected %f; got %f", 3, nfs.notifList.Len())
+		t.Errorf("bad number of elements in notifList: expected %d; got %d", 3, nfs.notifList.Len())
 	}
 	if nfs.currently_showing != nfs.notifList.Front() {
 		t.Error("currently_showing should be pointing to the front of list")
 	}
 	if nfs.currently_showing.Value.(*notif).id != id2 {
-		t.Errorf("currently_showing has id %f but expected n2.id %f",
+		t.Errorf("currently_showing has id %d but expected n2.id %d",
 			nfs.currently_showing.Value.(*notif).id, id2)
 	}
-	if nfs.seeking_at != -1 {
+	if nfs.seeking_at != 0 {
 		t.Error("seeking at the wrong time!")
 	}
 
 	//
 }
+
+func TestTimeoutRotation(t *testing.T) {
+	nfs, _, _ := newTestState(defaultConfig())
+
+	id1, waitTime := makeTestNotif(nfs, 0, "1", "0")
+	id2, _ := makeTestNotif(nfs, 0, "2", "0")
+	id3, _ := makeTestNotif(nfs, 0, "3", "0")
+
+	// n1 has been shown for the 2 seconds it took n2 and n3 to arrive
+	advance(nfs, time.Duration(waitTime-3)*time.Second)
+	if showingId(nfs) != id1 {
+		t.Error("n1 expired early")
+	}
+	advance(nfs, time.Second)
+	if showingId(nfs) != id2 {
+		t.Errorf("showing %d after n1 expired, expected n2 %d", showingId(nfs), id2)
+	}
+	if expirySecs(nfs) != waitTime {
+		t.Error("n2 did not get a full timeout:", expirySecs(nfs))
+	}
+
+	advance(nfs, time.Duration(waitTime)*time.Second)
+	if showingId(nfs) != id3 {
+		t.Errorf("showing %d after n2 expired, expected n3 %d", showingId(nfs), id3)
+	}
+	advance(nfs, time.Duration(waitTime)*time.Second)
+	if showingId(nfs) != 0 {
+		t.Error("still showing after every notification expired:", showingId(nfs))
+	}
+	if _, ok := nfs.sched.Deadline(timerKey{id3, TimerExpire}); ok {
+		t.Error("expiry deadline left behind")
+	}
+	for _, id := range []uint32{id1, id2, id3} {
+		if !nfs.findNotif(id).Value.(*notif).closed {
+			t.Errorf("%d was not closed when it expired", id)
+		}
+	}
+}
+
+func TestSeekingAge(t *testing.T) {
+	nfs, statuschange, _ := newTestState(defaultConfig())
+	last := func() string {
+		var st *status
+		for len(statuschange) > 0 {
+			st = <-statuschange
+		}
+		if st == nil {
+			return ""
+		}
+		return st.text
+	}
+
+	id1, _ := makeTestNotif(nfs, 0, "1", "0")
+	advance(nfs, 10*time.Minute)
+	makeTestNotif(nfs, id1, "1", "1")
+	advance(nfs, 5*time.Minute)
+	if got := last(); got != "" {
+		t.Error("statusline shown after the notification expired:", got)
+	}
+
+	nfs.SeekPrevMsg()
+	if got := last(); got != "(5m ago) 1 | 1" {
+		t.Error("bad statusline seeking to the latest revision:", got)
+	}
+	nfs.SeekPrevMsg()
+	if got := last(); got != "(15m ago) 1 | 0" {
+		t.Error("bad statusline seeking to the first revision:", got)
+	}
+
+	// Seeking doesn't expire, and the age keeps up with the clock
+	advance(nfs, time.Hour)
+	nfs.RefreshAge()
+	if got := last(); got != "(1h ago) 1 | 0" {
+		t.Error("bad statusline after an hour of seeking:", got)
+	}
+}
+
+func TestReplaceOrder(t *testing.T) {
+	nfs, _, _ := newTestState(defaultConfig())
+	order := func() []uint32 {
+		var ids []uint32
+		for e := nfs.notifList.Front(); e != nil; e = e.Next() {
+			ids = append(ids, e.Value.(*notif).id)
+		}
+		return ids
+	}
+	same := func(a, b []uint32) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	id1, waitTime := makeTestNotif(nfs, 0, "1", "0")
+	id2, _ := makeTestNotif(nfs, 0, "2", "0")
+	id3, _ := makeTestNotif(nfs, 0, "3", "0")
+
+	// A replaced notification moves to the back, behind the ones waiting to
+	// be shown, even if it hasn't been seen yet
+	makeTestNotif(nfs, id2, "2", "1")
+	if o := order(); !same(o, []uint32{id1, id3, id2}) {
+		t.Error("replacing an unseen notification did not move it to the back:", o)
+	}
+
+	// Once seen, a replaced notification is shown again
+	advance(nfs, time.Duration(waitTime)*time.Second)
+	makeTestNotif(nfs, id1, "1", "1")
+	if o := order(); !same(o, []uint32{id3, id2, id1}) {
+		t.Error("replacing a seen notification did not move it to the back:", o)
+	}
+	if nfs.findNotif(id1).Value.(*notif).seen_by_user {
+		t.Error("replaced notification is still seen")
+	}
+
+	var shown []uint32
+	for i := 0; i < 4 && nfs.currently_showing != nil; i++ {
+		shown = append(shown, nfs.currently_showing.Value.(*notif).id)
+		advance(nfs, time.Duration(waitTime)*time.Second)
+	}
+	if !same(shown, []uint32{id3, id2, id1}) {
+		t.Error("notifications shown in the wrong order:", shown)
+	}
+}
+
+func TestCloseReasons(t *testing.T) {
+	nfs, _, signals := newTestState(defaultConfig())
+
+	id1, _ := makeTestNotif(nfs, 0, "1", "0")
+	id2, _ := makeTestNotif(nfs, 0, "2", "0")
+
+	expectClosed := func(id uint32, reason closeReason) {
+		select {
+		case sig := <-signals:
+			if sig.name != "NotificationClosed" ||
+				sig.body[0] != id || sig.body[1] != uint32(reason) {
+				t.Errorf("expected close of %d with reason %d, got %s %v",
+					id, reason, sig.name, sig.body)
+			}
+		default:
+			t.Errorf("no signal emitted for %d", id)
+		}
+	}
+
+	// n2 is not being displayed, so closing it should not affect n1
+	nfs.CloseNotif(id2)
+	expectClosed(id2, ReasonClosed)
+	if nfs.notifList.Len() != 1 {
+		t.Error("n2 was not removed from notifList")
+	}
+	if nfs.currently_showing.Value.(*notif).id != id1 {
+		t.Error("closing n2 changed the displayed notification")
+	}
+
+	// Expired notifications stay in the list, but are only closed once
+	nfs.ExpireCurrent()
+	expectClosed(id1, ReasonExpired)
+	if nfs.notifList.Len() != 1 {
+		t.Error("n1 was removed from notifList after expiring")
+	}
+	if nfs.currently_showing != nil {
+		t.Error("n1 still displayed after expiring")
+	}
+	nfs.CloseNotif(id1)
+	if len(signals) != 0 {
+		t.Error("n1 was closed twice")
+	}
+
+	id3, _ := makeTestNotif(nfs, 0, "3", "0")
+	nfs.DismissCurrent()
+	expectClosed(id3, ReasonDismissed)
+	if nfs.notifList.Len() != 0 || nfs.currently_showing != nil {
+		t.Error("n3 was not dismissed")
+	}
+}
+
+func TestInvokeAction(t *testing.T) {
+	nfs, statuschange, signals := newTestState(defaultConfig())
+
+	id, _ := makeTestNotif(nfs, 0, "1", "0")
+	nfs.currently_showing.Value.(*notif).actions = []string{
+		"default", "", "reply", "Reply"}
+	nfs.updateStatus()
+	if status := <-statuschange; status.text != "1 | 0" {
+		t.Error("bad initial status:", status.text)
+	}
+	status := <-statuschange
+	if status.text != "1 | 0 [Reply]" {
+		t.Error("action labels not shown:", status.text)
+	}
+	if !strings.Contains(jsonFormat{}.format(status),
+		`"actions":[{"key":"default","label":""},{"key":"reply","label":"Reply"}]`) {
+		t.Error("action keys not in the JSON status:", jsonFormat{}.format(status))
+	}
+	if r, _ := nfs.showNotif(id); len(r.Actions) != 2 ||
+		r.lines()[len(r.lines())-1] != "action\treply\tReply" {
+		t.Error("action keys not shown:", r.lines())
+	}
+
+	nfs.InvokeAction(0, "nonexistent")
+	if len(signals) != 0 || nfs.notifList.Len() != 1 {
+		t.Error("invoking an unknown action had an effect")
+	}
+
+	nfs.InvokeAction(id, "reply")
+	sig := <-signals
+	if sig.name != "ActionInvoked" || sig.body[0] != id || sig.body[1] != "reply" {
+		t.Error("bad ActionInvoked signal:", sig.name, sig.body)
+	}
+	sig = <-signals
+	if sig.name != "NotificationClosed" || sig.body[1] != uint32(ReasonDismissed) {
+		t.Error("notification not closed after invoking action")
+	}
+	if nfs.notifList.Len() != 0 {
+		t.Error("notification not removed after invoking action")
+	}
+}
+
+func TestUrgency(t *testing.T) {
+	nfs, _, _ := newTestState(defaultConfig())
+
+	notify := func(u urgency, s string) uint32 {
+		id := make(chan uint32, 1)
+		nfs.HandleNotifEvent(&notifEvent{
+			app_name:       "test",
+			text:           notiftext{time: nfs.clock.Now(), summary: s},
+			urgency:        u,
+			expire_timeout: -1,
+			id:             id,
+		})
+		return <-id
+	}
+
+	notify(UrgencyLow, "low")
+	if waitTime := expirySecs(nfs); waitTime != defaultLowTimeout {
+		t.Error("low urgency notification got timeout", waitTime)
+	}
+
+	normal := notify(UrgencyNormal, "normal")
+	crit := notify(UrgencyCritical, "critical")
+	if nfs.currently_showing.Value.(*notif).id != crit {
+		t.Error("critical notification did not interrupt")
+	}
+	if waitTime := expirySecs(nfs); waitTime != 0 {
+		t.Error("critical notification did not cancel the timer")
+	}
+
+	// critical notifications never expire, so only hiding it moves on
+	nfs.HideNotif(crit)
+	if nfs.currently_showing.Value.(*notif).id != normal {
+		t.Error("normal notification not shown after hiding critical one")
+	}
+}
+
+func TestTransientResident(t *testing.T) {
+	nfs, _, signals := newTestState(defaultConfig())
+
+	id := make(chan uint32, 1)
+	nfs.HandleNotifEvent(&notifEvent{
+		app_name:       "test",
+		text:           notiftext{time: nfs.clock.Now(), summary: "resident"},
+		actions:        []string{"open", "Open"},
+		resident:       true,
+		expire_timeout: -1,
+		id:             id,
+	})
+	resident := <-id
+	nfs.HandleNotifEvent(&notifEvent{
+		app_name:       "test",
+		text:           notiftext{time: nfs.clock.Now(), summary: "transient"},
+		transient:      true,
+		expire_timeout: -1,
+		id:             id,
+	})
+	<-id
+
+	nfs.InvokeAction(resident, "open")
+	if sig := <-signals; sig.name != "ActionInvoked" {
+		t.Error("action not invoked on resident notification")
+	}
+	if len(signals) != 0 || nfs.notifList.Len() != 2 {
+		t.Error("resident notification closed after invoking action")
+	}
+
+	// the resident notification expires and stays in the list, then the
+	// transient one expires and is removed
+	nfs.ExpireCurrent()
+	<-signals
+	nfs.ExpireCurrent()
+	<-signals
+	if nfs.notifList.Len() != 1 {
+		t.Error("transient notification kept after expiring")
+	}
+	if nfs.notifList.Front().Value.(*notif).id != resident {
+		t.Error("wrong notification removed after expiring")
+	}
+
+	// Transient notifications are also removed when hidden or seeked past
+	transient := func() uint32 {
+		nfs.HandleNotifEvent(&notifEvent{
+			app_name:       "test",
+			text:           notiftext{time: nfs.clock.Now(), summary: "transient"},
+			transient:      true,
+			expire_timeout: -1,
+			id:             id,
+		})
+		return <-id
+	}
+	hidden := transient()
+	if err := nfs.HideNotif(hidden); err != nil {
+		t.Fatal(err)
+	}
+	if sig := <-signals; sig.name != "NotificationClosed" ||
+		sig.body[0] != hidden || sig.body[1] != uint32(ReasonDismissed) {
+		t.Error("hidden transient notification not closed:", sig.name, sig.body)
+	}
+	if nfs.findNotif(hidden) != nil || nfs.notifList.Len() != 1 {
+		t.Error("transient notification kept after being hidden")
+	}
+
+	seeked := transient()
+	nfs.SeekPrevNotif()
+	if nfs.findNotif(seeked) != nil || nfs.notifList.Len() != 1 {
+		t.Error("transient notification kept after seeking past it")
+	}
+	if nfs.currently_showing == nil ||
+		nfs.currently_showing.Value.(*notif).id != resident {
+		t.Error("seeking past a transient notification went to the wrong one")
+	}
+	// but not when a critical notification pushes them off the statusline
+	nfs.DismissAll()
+	for len(signals) > 0 {
+		<-signals
+	}
+	interrupted := transient()
+	nfs.HandleNotifEvent(&notifEvent{
+		app_name:       "test",
+		text:           notiftext{time: nfs.clock.Now(), summary: "critical"},
+		urgency:        UrgencyCritical,
+		expire_timeout: -1,
+		id:             id,
+	})
+	<-id
+	if len(signals) != 0 || nfs.findNotif(interrupted) == nil {
+		t.Error("interrupted transient notification was closed")
+	}
+	nfs.DismissCurrent()
+	if showingId(nfs) != interrupted {
+		t.Error("interrupted transient notification not shown again")
+	}
+}
+
+func TestIdCommands(t *testing.T) {
+	nfs, _, _ := newTestState(defaultConfig())
+
+	run := func(button RemoteButton, args ...string) error {
+		_, err := nfs.RunCommand(&remoteCommand{button: button, args: args})
+		return err
+	}
+
+	id1 := notifyApp(nfs, "a")
+	id2 := notifyApp(nfs, "b")
+	id3 := notifyApp(nfs, "a")
+	id4 := notifyApp(nfs, "c d")
+
+	if err := run(Dismiss, "2"); err != nil || nfs.findNotif(id2) != nil {
+		t.Error("dismiss <id> did not remove n2:", err)
+	}
+	if showingId(nfs) != id1 || nfs.seeking_at != -1 {
+		t.Error("dismissing another notification changed the display")
+	}
+	if err := run(Hide, "3"); err != nil ||
+		!nfs.findNotif(id3).Value.(*notif).seen_by_user {
+		t.Error("hide <id> did not hide n3:", err)
+	}
+	if showingId(nfs) != id1 {
+		t.Error("hiding another notification changed the display")
+	}
+	if run(Hide, "99") == nil || run(Dismiss, "x") == nil {
+		t.Error("commands with bad ids did not fail")
+	}
+
+	if err := run(Goto, "3"); err != nil || showingId(nfs) != id3 || nfs.seeking_at != 0 {
+		t.Error("goto did not seek to n3:", err)
+	}
+
+	if err := run(DismissApp, "a"); err != nil || nfs.notifList.Len() != 1 {
+		t.Error("dismissapp did not remove every notification from a:", err)
+	}
+	if showingId(nfs) != id4 {
+		t.Error("display did not move on after dismissing what was shown")
+	}
+	if err := run(HideApp, "c", "d"); err != nil ||
+		!nfs.findNotif(id4).Value.(*notif).seen_by_user {
+		t.Error("hideapp did not hide the notification from \"c d\":", err)
+	}
+}
+
+func TestNotifIndex(t *testing.T) {
+	nfs, _, _ := newTestState(defaultConfig())
+	checkIndex := func(when string) {
+		if len(nfs.notifIndex) != nfs.notifList.Len() {
+			t.Errorf("%s: index has %d notifications but the list has %d",
+				when, len(nfs.notifIndex), nfs.notifList.Len())
+		}
+		var unseen, critical []*list.Element
+		for e := nfs.notifList.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*notif)
+			if nfs.notifIndex[p.id] != e {
+				t.Errorf("%s: %d is not indexed", when, p.id)
+			}
+			if !p.seen_by_user {
+				unseen = append(unseen, e)
+				if p.urgency == UrgencyCritical {
+					critical = append(critical, e)
+				}
+			}
+		}
+		checkQueue := func(name string, q *list.List, want []*list.Element) {
+			u := q.Front()
+			for _, e := range want {
+				if u == nil || u.Value != e {
+					t.Errorf("%s: %s queue out of order", when, name)
+					return
+				}
+				u = u.Next()
+			}
+			if u != nil {
+				t.Errorf("%s: %s queue has seen notifications", when, name)
+			}
+		}
+		checkQueue("unseen", nfs.unseen, unseen)
+		checkQueue("critical", nfs.unseen_critical, critical)
+		if nfs.unreadCount() != len(unseen) {
+			t.Errorf("%s: %d unread counted but %d in the list",
+				when, nfs.unreadCount(), len(unseen))
+		}
+	}
+
+	id1, _ := makeTestNotif(nfs, 0, "1", "0")
+	id2, _ := makeTestNotif(nfs, 0, "2", "0")
+	id3, _ := makeTestNotif(nfs, 0, "3", "0")
+	checkIndex("after adding")
+
+	nfs.HideNotif(id3)
+	nfs.SnoozeNotif(id2, time.Minute)
+	checkIndex("after hiding")
+	advance(nfs, time.Minute)
+	checkIndex("after waking")
+
+	getId := make(chan uint32, 1)
+	nfs.HandleNotifEvent(&notifEvent{
+		app_name:       "test",
+		text:           notiftext{time: nfs.clock.Now(), summary: "critical"},
+		urgency:        UrgencyCritical,
+		expire_timeout: -1,
+		id:             getId,
+	})
+	crit := <-getId
+	makeTestNotif(nfs, 0, "4", "0")
+	checkIndex("after a critical notification")
+	makeTestNotif(nfs, crit, "critical", "no longer")
+	checkIndex("after the critical notification was replaced")
+
+	makeTestNotif(nfs, id1, "1", "1")
+	checkIndex("after replacing")
+
+	nfs.CloseNotif(id2)
+	nfs.DismissCurrent()
+	checkIndex("after closing")
+	if nfs.findNotif(id2) != nil {
+		t.Error("closed notification can still be found")
+	}
+
+	// An id that an application made up is not reused
+	made, _ := makeTestNotif(nfs, 9, "9", "0")
+	nfs.notif_counter = made
+	if id, _ := makeTestNotif(nfs, 0, "10", "0"); id == made || id == id3 {
+		t.Error("id in use given to a new notification:", id)
+	}
+	checkIndex("after making up an id")
+
+	nfs.DismissAll()
+	checkIndex("after dismissing everything")
+}
+
+// benchmarkHandleNotifEvent measures adding a notification and replacing the
+// oldest one, with n notifications that have been seen already stored.  If
+// dismiss is true, each notification is dismissed once it is shown, so the
+// statusline is empty when the next one arrives and what to show next has to
+// be found among everything stored.  Otherwise the first notification stays
+// on the statusline, and the others wait behind it.
+func benchmarkHandleNotifEvent(b *testing.B, n int, dismiss bool) {
+	statuschange := make(chan *status)
+	signals := make(chan *dbusSignal)
+	go func() {
+		for range statuschange {
+		}
+	}()
+	go func() {
+		for range signals {
+		}
+	}()
+	defer close(statuschange)
+	defer close(signals)
+
+	conf := defaultConfig()
+	conf.Limits.Notifications = 0
+	nfs := newNFState(statuschange, signals, conf, newFakeClock())
+	for i := 0; i < n; i++ {
+		nfs.pushNotif(&notif{
+			id:           nfs.newId(),
+			app_name:     "bench",
+			text:         []notiftext{{nfs.clock.Now(), "old", ""}},
+			seen_by_user: true,
+			closed:       true,
+		})
+	}
+
+	getId := make(chan uint32, 1)
+	send := func(replaces_id uint32) {
+		nfs.HandleNotifEvent(&notifEvent{
+			app_name:       "bench",
+			replaces_id:    replaces_id,
+			text:           notiftext{nfs.clock.Now(), "new", ""},
+			expire_timeout: -1,
+			id:             getId,
+		})
+		<-getId
+		if dismiss {
+			nfs.DismissCurrent()
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		send(0)
+		send(nfs.notifList.Front().Value.(*notif).id)
+	}
+}
+
+func BenchmarkHandleNotifEvent10k(b *testing.B) {
+	benchmarkHandleNotifEvent(b, 10000, true)
+}
+
+func BenchmarkHandleNotifEvent100k(b *testing.B) {
+	benchmarkHandleNotifEvent(b, 100000, true)
+}
+
+func BenchmarkHandleNotifEventShown10k(b *testing.B) {
+	benchmarkHandleNotifEvent(b, 10000, false)
+}
+
+func BenchmarkHandleNotifEventShown100k(b *testing.B) {
+	benchmarkHandleNotifEvent(b, 100000, false)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// The format status updates are sent to a subscriber in, chosen with
+// "sub <format>".
+type outputFormat interface {
+	// header returns the lines sent when the client subscribes, before the
+	// first status update.
+	header() []string
+
+	// format returns the line sent for a status update.
+	format(st *status) string
+}
+
+// An outputFormat for bars that send click events back over the same
+// connection once subscribed, instead of commands.
+type clickableFormat interface {
+	outputFormat
+
+	// click returns the command a line sent by the bar maps to, or nil if
+	// it should be ignored.
+	click(line string) *remoteCommand
+}
+
+// newOutputFormat returns the format with the given name.  If name is "",
+// the format matching the protocol the client is using is returned.
+func newOutputFormat(name string, useJSON bool) (outputFormat, error) {
+	switch name {
+	case "":
+		if useJSON {
+			return jsonFormat{}, nil
+		}
+		return plainFormat{}, nil
+	case "plain":
+		return plainFormat{}, nil
+	case "json":
+		return jsonFormat{}, nil
+	case "i3bar", "swaybar":
+		return &i3barFormat{name: name}, nil
+	case "waybar":
+		return waybarFormat{}, nil
+	case "polybar", "lemonbar":
+		return lemonbarFormat{name: name, exe: executable()}, nil
+	case "tmux":
+		return tmuxFormat{}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", name)
+}
+
+// config returns the config the status was rendered with, or the default
+// config for the status sent before anything has been rendered.
+func (st *status) config() *Config {
+	if st.conf == nil {
+		return defaultConfig()
+	}
+	return st.conf
+}
+
+// color returns the color configured for the urgency of the notification
+// being shown, or "" if it should be shown in the default color.
+func (st *status) color() string {
+	c := st.config()
+	switch st.urgency {
+	case UrgencyLow:
+		return c.Colors.Low
+	case UrgencyCritical:
+		return c.Colors.Critical
+	}
+	return c.Colors.Normal
+}
+
+// urgencyName returns the name of an urgency level, as used for CSS classes.
+func urgencyName(u urgency) string {
+	switch u {
+	case UrgencyLow:
+		return "low"
+	case UrgencyCritical:
+		return "critical"
+	}
+	return "normal"
+}
+
+// The plain text statusline, one line per update.
+type plainFormat struct{}
+
+func (plainFormat) header() []string { return nil }
+
+func (plainFormat) format(st *status) string {
+	return st.line("plain")
+}
+
+// A status update sent to subscribers using the JSON protocol.
+type jsonStatus struct {
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	Id        uint32 `json:"id,omitempty"`
+	AppName   string `json:"app_name,omitempty"`
+	Summary   string `json:"summary,omitempty"`
+	Body      string `json:"body,omitempty"`
+	Urgency   int    `json:"urgency"`
+	Seeking   bool   `json:"seeking"`
+	SeekingAt int    `json:"seeking_at"`
+	Revisions int    `json:"revisions"`
+	Unread    int    `json:"unread"`
+	Dnd       bool   `json:"dnd"`
+
+	// The actions of the notification being shown, for invoke.
+	Actions []action `json:"actions,omitempty"`
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) header() []string { return nil }
+
+func (jsonFormat) format(st *status) string {
+	b, _ := json.Marshal(&jsonStatus{
+		Type:      "status",
+		Text:      st.line("json"),
+		Id:        st.id,
+		AppName:   st.app_name,
+		Summary:   st.summary,
+		Body:      st.body,
+		Urgency:   int(st.urgency),
+		Seeking:   st.seeking_at >= 0,
+		SeekingAt: st.seeking_at,
+		Revisions: st.revisions,
+		Unread:    st.unread,
+		Dnd:       st.dnd,
+		Actions:   st.actions,
+	})
+	return string(b)
+}
+
+// A block of the i3bar protocol, which swaybar also speaks.
+type i3barBlock struct {
+	Name      string `json:"name"`
+	FullText  string `json:"full_text"`
+	ShortText string `json:"short_text,omitempty"`
+	Color     string `json:"color,omitempty"`
+	Urgent    bool   `json:"urgent,omitempty"`
+}
+
+// A click event sent by i3bar.
+type i3barClick struct {
+	Name   string `json:"name"`
+	Button int    `json:"button"`
+}
+
+// The i3bar protocol: a header, then an endless JSON array with one array of
+// blocks per update.
+type i3barFormat struct {
+	name    string
+	started bool
+}
+
+func (f *i3barFormat) header() []string {
+	return []string{`{"version":1,"click_events":true}`, "["}
+}
+
+func (f *i3barFormat) format(st *status) string {
+	b, _ := json.Marshal([]i3barBlock{{
+		Name:      "simplenotif",
+		FullText:  st.line(f.name),
+		ShortText: st.summary,
+		Color:     st.color(),
+		Urgent:    st.urgency == UrgencyCritical,
+	}})
+	if f.started {
+		return "," + string(b)
+	}
+	f.started = true
+	return string(b)
+}
+
+// Left click shows the next message, right click dismisses and scrolling
+// seeks through the history.
+func (f *i3barFormat) click(line string) *remoteCommand {
+	line = strings.TrimLeft(strings.TrimSpace(line), ",")
+	if line == "" || line == "[" {
+		return nil
+	}
+	var ev i3barClick
+	if err := json.Unmarshal([]byte(line), &ev); err != nil {
+		return nil
+	}
+	switch ev.Button {
+	case 1:
+		return &remoteCommand{button: NextMsg}
+	case 3:
+		return &remoteCommand{button: Dismiss}
+	case 4:
+		return &remoteCommand{button: PrevMsg}
+	case 5:
+		return &remoteCommand{button: NextMsg}
+	}
+	return nil
+}
+
+// The JSON a waybar custom module with "return-type": "json" reads.
+type waybarStatus struct {
+	Text       string   `json:"text"`
+	Tooltip    string   `json:"tooltip"`
+	Class      []string `json:"class"`
+	Alt        string   `json:"alt"`
+	Percentage int      `json:"percentage"`
+}
+
+// Output for waybar custom modules.  The tooltip holds every message of the
+// notification being shown, and the classes give its urgency and whether the
+// user is seeking, so they can be styled with CSS.  The percentage is how far
+// through the notification's messages the user has seeked.
+type waybarFormat struct{}
+
+func (waybarFormat) header() []string { return nil }
+
+func (waybarFormat) format(st *status) string {
+	w := &waybarStatus{
+		Text:  st.line("waybar"),
+		Class: []string{},
+		Alt:   st.app_name,
+	}
+	if st.dnd {
+		w.Class = append(w.Class, "dnd")
+	}
+	if st.id == 0 {
+		w.Class = append(w.Class, "empty")
+	} else {
+		w.Class = append(w.Class, urgencyName(st.urgency))
+		w.Percentage = 100
+		if st.seeking_at >= 0 {
+			w.Class = append(w.Class, "seeking")
+			w.Percentage = (st.seeking_at + 1) * 100 / st.revisions
+		}
+	}
+
+	sep := st.config().Separator
+	lines := make([]string, len(st.messages))
+	for i, m := range st.messages {
+		lines[i] = m.time.Format("15:04") + " " +
+			html.EscapeString(m.summary+sep+m.body)
+	}
+	w.Tooltip = strings.Join(lines, "\n")
+
+	b, _ := json.Marshal(w)
+	return string(b)
+}
+
+// The buttons of polybar and lemonbar click areas, and the commands they
+// send, matching the i3bar format.
+var barClicks = []struct {
+	button int
+	cmd    RemoteButton
+}{
+	{1, NextMsg},
+	{3, Dismiss},
+	{4, PrevMsg},
+	{5, NextMsg},
+}
+
+// Output for polybar and lemonbar, which share a markup syntax.  Clicking
+// runs "simplenotif ctl" with the socket of this simplenotif to send the
+// command back.  polybar runs the command itself; lemonbar prints it, so its
+// output should be piped to sh.
+type lemonbarFormat struct {
+	name string
+	exe  string
+}
+
+func (lemonbarFormat) header() []string { return nil }
+
+func (f lemonbarFormat) format(st *status) string {
+	text := st.line(f.name)
+	if text == "" {
+		return ""
+	}
+	if c := st.color(); c != "" {
+		text = "%{F" + c + "}" + text + "%{F-}"
+	}
+	if st.id == 0 {
+		return text
+	}
+
+	ctl := strings.ReplaceAll(ctlCommand(f.exe, st.config().Socket), ":", `\:`)
+	for _, c := range barClicks {
+		text = fmt.Sprintf("%%{A%d:%s %s:}%s%%{A}", c.button, ctl, c.cmd, text)
+	}
+	return text
+}
+
+// Output for the tmux status line.  tmux has no click areas that can run
+// commands, so it only gets colors.
+type tmuxFormat struct{}
+
+func (tmuxFormat) header() []string { return nil }
+
+func (tmuxFormat) format(st *status) string {
+	text := st.line("tmux")
+	if c := st.color(); c != "" && text != "" {
+		text = "#[fg=" + c + "]" + text + "#[default]"
+	}
+	return text
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestI3barFormat(t *testing.T) {
+	f, err := newOutputFormat("i3bar", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := f.header(); len(h) != 2 || !strings.Contains(h[0], `"click_events":true`) {
+		t.Error("bad i3bar header:", h)
+	}
+
+	st := &status{text: "a | b", summary: "a", urgency: UrgencyCritical}
+	var blocks []i3barBlock
+	if err := json.Unmarshal([]byte(f.format(st)), &blocks); err != nil {
+		t.Fatal("first update is not a JSON array:", err)
+	}
+	if len(blocks) != 1 || blocks[0].FullText != "a | b" ||
+		blocks[0].Color != defaultConfig().Colors.Critical || !blocks[0].Urgent {
+		t.Error("bad i3bar block:", blocks)
+	}
+	if next := f.format(st); !strings.HasPrefix(next, ",[") {
+		t.Error("later updates should continue the array:", next)
+	}
+
+	c := f.(clickableFormat)
+	for line, button := range map[string]RemoteButton{
+		`{"name":"simplenotif","button":1}`:  NextMsg,
+		`,{"name":"simplenotif","button":3}`: Dismiss,
+		`,{"name":"simplenotif","button":4}`: PrevMsg,
+	} {
+		if cmd := c.click(line); cmd == nil || cmd.button != button {
+			t.Errorf("click %s should map to %s", line, button)
+		}
+	}
+	if c.click("[") != nil {
+		t.Error("start of the click event array was not ignored")
+	}
+}
+
+func TestWaybarFormat(t *testing.T) {
+	f, _ := newOutputFormat("waybar", false)
+
+	var w waybarStatus
+	json.Unmarshal([]byte(f.format(&status{seeking_at: -1})), &w)
+	if len(w.Class) != 1 || w.Class[0] != "empty" {
+		t.Error("bad class when nothing is shown:", w.Class)
+	}
+
+	st := &status{
+		text:     "a | <b>",
+		id:       1,
+		app_name: "app",
+		urgency:  UrgencyNormal,
+		messages: []notiftext{
+			{time.Now(), "a", "first"},
+			{time.Now(), "a", "<b>"},
+		},
+		seeking_at: 0,
+		revisions:  2,
+	}
+	json.Unmarshal([]byte(f.format(st)), &w)
+	if w.Text != "a | &lt;b&gt;" || w.Alt != "app" || w.Percentage != 50 {
+		t.Error("bad waybar output:", w)
+	}
+	if len(w.Class) != 2 || w.Class[0] != "normal" || w.Class[1] != "seeking" {
+		t.Error("bad class while seeking:", w.Class)
+	}
+	lines := strings.Split(w.Tooltip, "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], "a | &lt;b&gt;") {
+		t.Error("bad tooltip:", w.Tooltip)
+	}
+}
+
+func TestMarkupFormats(t *testing.T) {
+	conf := defaultConfig()
+	conf.Socket = "/tmp/it's.sock"
+	st := &status{
+		text:    "100% #1",
+		id:      1,
+		urgency: UrgencyCritical,
+		conf:    conf,
+	}
+	red := conf.Colors.Critical
+
+	f := lemonbarFormat{name: "polybar", exe: "simplenotif"}
+	got := f.format(st)
+	want := "%{F" + red + "}100% #1%{F-}"
+	if !strings.Contains(got, want) {
+		t.Errorf("lemonbar output %q does not contain %q", got, want)
+	}
+	ctl := `'simplenotif' -socket '/tmp/it'\''s.sock' ctl`
+	if !strings.HasPrefix(got, "%{A5:"+ctl+" nextmsg:}%{A4:"+ctl+" prevmsg:}") ||
+		strings.Count(got, "%{A}") != 4 {
+		t.Error("bad lemonbar click areas:", got)
+	}
+	if got := (lemonbarFormat{name: "polybar", exe: "C:/ctl"}).format(st); !strings.Contains(got, `'C\:/ctl'`) {
+		t.Error("colon in the ctl command was not escaped:", got)
+	}
+	evil := &status{text: "%{A:rm -rf ~:}x%{A} %%{A3:reboot:}", id: 1}
+	if got := f.format(evil); strings.Contains(got, "%{A:rm") ||
+		strings.Contains(got, "%{A3:reboot") || strings.Count(got, "%{A") != 8 {
+		t.Error("notification text injected a click area:", got)
+	}
+	if got := lemonbarEscape("a%") + lemonbarEscape("{A:rm:}"); strings.Contains(got, "%{") {
+		t.Error("text split across fields injected a tag:", got)
+	}
+	if got := f.format(&status{seeking_at: -1}); got != "" {
+		t.Error("nothing shown should be empty:", got)
+	}
+
+	got = tmuxFormat{}.format(st)
+	if got != "#[fg="+red+"]100% ##1#[default]" {
+		t.Error("bad tmux output:", got)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many messages the history command returns if no count is given.
+const defaultHistoryCount = 10
+
+// The result of a query command.  In the JSON protocol it is sent as the
+// "result" of the response; in the plain text protocol, its lines are sent.
+type queryResult interface {
+	lines() []string
+}
+
+// oneLine replaces the tabs and newlines in s with spaces, so it can be sent
+// in a single tab-separated field of the plain text protocol.
+func oneLine(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+type listEntry struct {
+	Id        uint32 `json:"id"`
+	AppName   string `json:"app_name"`
+	Summary   string `json:"summary"`
+	Seen      bool   `json:"seen"`
+	Revisions int    `json:"revisions"`
+}
+
+// The result of "list": every notification, oldest first.
+type listResult []listEntry
+
+func (l listResult) lines() []string {
+	var lines []string
+	for _, e := range l {
+		seen := "unseen"
+		if e.Seen {
+			seen = "seen"
+		}
+		lines = append(lines, fmt.Sprintf("%d\t%s\t%s\t%s", e.Id,
+			oneLine(e.AppName), seen, oneLine(e.Summary)))
+	}
+	return lines
+}
+
+type revision struct {
+	Time    time.Time `json:"time"`
+	Summary string    `json:"summary"`
+	Body    string    `json:"body"`
+}
+
+// An action of a notification: the key that invoke takes, and the label the
+// user sees.
+type action struct {
+	Key   string `json:"key"`
+	Label string `json:"label"`
+}
+
+// The result of "show <id>": every message of a notification, oldest first,
+// and its actions.
+type showResult struct {
+	Id       uint32     `json:"id"`
+	AppName  string     `json:"app_name"`
+	Urgency  int        `json:"urgency"`
+	Category string     `json:"category,omitempty"`
+	Seen     bool       `json:"seen"`
+	Text     []revision `json:"text"`
+	Actions  []action   `json:"actions,omitempty"`
+}
+
+func (r *showResult) lines() []string {
+	var lines []string
+	for _, t := range r.Text {
+		lines = append(lines, fmt.Sprintf("%s\t%s\t%s",
+			t.Time.Format(time.RFC3339), oneLine(t.Summary), oneLine(t.Body)))
+	}
+	for _, a := range r.Actions {
+		lines = append(lines, fmt.Sprintf("action\t%s\t%s",
+			oneLine(a.Key), oneLine(a.Label)))
+	}
+	return lines
+}
+
+type historyEntry struct {
+	Id      uint32    `json:"id"`
+	AppName string    `json:"app_name"`
+	Time    time.Time `json:"time"`
+	Summary string    `json:"summary"`
+	Body    string    `json:"body"`
+}
+
+// The result of "history [n]": the last n messages from any notification,
+// oldest first.
+type historyResult []historyEntry
+
+func (h historyResult) lines() []string {
+	var lines []string
+	for _, e := range h {
+		lines = append(lines, fmt.Sprintf("%d\t%s\t%s\t%s\t%s", e.Id,
+			e.Time.Format(time.RFC3339), oneLine(e.AppName),
+			oneLine(e.Summary), oneLine(e.Body)))
+	}
+	return lines
+}
+
+// The result of "count".
+type countResult struct {
+	Unread int `json:"unread"`
+	Total  int `json:"total"`
+}
+
+func (c *countResult) lines() []string {
+	return []string{fmt.Sprintf("%d %d", c.Unread, c.Total)}
+}
+
+func (s *nfState) listNotifs() listResult {
+	l := listResult{}
+	for e := s.notifList.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*notif)
+		l = append(l, listEntry{
+			Id:        p.id,
+			AppName:   p.app_name,
+			Summary:   p.text[len(p.text)-1].summary,
+			Seen:      p.seen_by_user,
+			Revisions: len(p.text),
+		})
+	}
+	return l
+}
+
+func (s *nfState) showNotif(id uint32) (*showResult, error) {
+	e := s.findNotif(id)
+	if e == nil {
+		return nil, noSuchNotif(id)
+	}
+	p := e.Value.(*notif)
+	r := &showResult{
+		Id:       p.id,
+		AppName:  p.app_name,
+		Urgency:  int(p.urgency),
+		Category: p.category,
+		Seen:     p.seen_by_user,
+		Actions:  p.actionList(),
+	}
+	for _, t := range p.text {
+		r.Text = append(r.Text, revision{t.time, t.summary, t.body})
+	}
+	return r, nil
+}
+
+func (s *nfState) messageHistory(n int) historyResult {
+	h := historyResult{}
+	for e := s.notifList.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*notif)
+		for _, t := range p.text {
+			h = append(h, historyEntry{p.id, p.app_name, t.time, t.summary, t.body})
+		}
+	}
+	sort.SliceStable(h, func(i, j int) bool {
+		return h[i].Time.Before(h[j].Time)
+	})
+	if len(h) > n {
+		h = h[len(h)-n:]
+	}
+	return h
+}
+
+func (s *nfState) countNotifs() *countResult {
+	return &countResult{
+		Unread: s.unreadCount(),
+		Total:  s.notifList.Len(),
+	}
+}
+
+// parseId parses a notification id given as a command argument.
+func parseId(arg string) (uint32, error) {
+	id, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("bad notification id %q", arg)
+	}
+	return uint32(id), nil
+}
+
+// idArg parses the only argument of a command that takes a notification id.
+func idArg(cmd *remoteCommand) (uint32, error) {
+	if len(cmd.args) != 1 {
+		return 0, fmt.Errorf("usage: %s <id>", cmd.button)
+	}
+	return parseId(cmd.args[0])
+}
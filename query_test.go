@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestQueries(t *testing.T) {
+	nfs, _, _ := newTestState(defaultConfig())
+
+	id1, _ := makeTestNotif(nfs, 0, "1", "0")
+	id2, _ := makeTestNotif(nfs, 0, "2", "0")
+	makeTestNotif(nfs, id1, "1", "1")
+
+	run := func(button RemoteButton, args ...string) (queryResult, error) {
+		return nfs.RunCommand(&remoteCommand{button: button, args: args})
+	}
+
+	result, _ := run(List)
+	l := result.(listResult)
+	if len(l) != 2 || l[0].Id != id2 || l[1].Id != id1 || l[1].Revisions != 2 {
+		t.Error("bad list:", l)
+	}
+	if l[0].Seen || !l[1].Seen {
+		t.Error("bad seen state in list:", l)
+	}
+
+	result, err := run(Show, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	show := result.(*showResult)
+	if len(show.Text) != 2 || show.Text[1].Body != "1" {
+		t.Error("bad show:", show)
+	}
+	if _, err := run(Show, "99"); err == nil {
+		t.Error("showing a nonexistent notification did not fail")
+	}
+
+	result, _ = run(History, "2")
+	h := result.(historyResult)
+	if len(h) != 2 || h[0].Id != id2 || h[1].Body != "1" {
+		t.Error("bad history:", h)
+	}
+
+	result, _ = run(Count)
+	if c := result.(*countResult); c.Unread != 1 || c.Total != 2 {
+		t.Error("bad count:", c)
+	}
+	if lines := result.lines(); len(lines) != 1 || lines[0] != "1 2" {
+		t.Error("bad plain text count:", lines)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// A rule from the config file.  A rule applies to a notification if every
+// match that is set matches it; app_name, summary and body are regular
+// expressions.  Every rule that applies is applied, in order, and later rules
+// see the changes made by earlier ones.
+type ruleConfig struct {
+	AppName  string `toml:"app_name"`
+	Summary  string `toml:"summary"`
+	Body     string `toml:"body"`
+	Category string `toml:"category"`
+	Urgency  string `toml:"urgency"`
+
+	// Drop the notification without storing it.
+	Drop bool `toml:"drop"`
+
+	// Store the notification, but never show it on the statusline.
+	Silent bool `toml:"silent"`
+
+	// How many seconds to show the notification for, or 0 to show it until
+	// the user does something.
+	Timeout *int `toml:"timeout"`
+
+	SetUrgency string `toml:"set_urgency"`
+
+	// Templates the summary and body are replaced with.
+	RewriteSummary string `toml:"rewrite_summary"`
+	RewriteBody    string `toml:"rewrite_body"`
+
+	// Mark the notification as seen, so that it is only shown if it can be
+	// shown right away.
+	MarkSeen bool `toml:"mark_seen"`
+}
+
+// A compiled ruleConfig.
+type rule struct {
+	conf           *ruleConfig
+	appName        *regexp.Regexp
+	summary        *regexp.Regexp
+	body           *regexp.Regexp
+	urgency        urgency
+	setUrgency     urgency
+	rewriteSummary *template.Template
+	rewriteBody    *template.Template
+}
+
+// The fields rewrite templates can use.
+type ruleFields struct {
+	AppName  string
+	Summary  string
+	Body     string
+	Category string
+	Urgency  string
+}
+
+// parseUrgency parses the name of an urgency level.
+func parseUrgency(name string) (urgency, error) {
+	switch name {
+	case "low":
+		return UrgencyLow, nil
+	case "normal":
+		return UrgencyNormal, nil
+	case "critical":
+		return UrgencyCritical, nil
+	}
+	return 0, fmt.Errorf("%q is not low, normal or critical", name)
+}
+
+// compileRules compiles the configured rules, so they are ready to be
+// applied.
+func (c *Config) compileRules() error {
+	var rules []*rule
+	for i := range c.Rules {
+		rc := &c.Rules[i]
+		r := &rule{conf: rc}
+		field := func(name string) string {
+			return fmt.Sprintf("rules[%d].%s", i, name)
+		}
+
+		var err error
+		for _, re := range []struct {
+			name string
+			expr string
+			dest **regexp.Regexp
+		}{
+			{"app_name", rc.AppName, &r.appName},
+			{"summary", rc.Summary, &r.summary},
+			{"body", rc.Body, &r.body},
+		} {
+			if re.expr == "" {
+				continue
+			}
+			if *re.dest, err = regexp.Compile(re.expr); err != nil {
+				return fmt.Errorf("%s: %v", field(re.name), err)
+			}
+		}
+		if rc.Urgency != "" {
+			if r.urgency, err = parseUrgency(rc.Urgency); err != nil {
+				return fmt.Errorf("%s: %v", field("urgency"), err)
+			}
+		}
+		if rc.SetUrgency != "" {
+			if r.setUrgency, err = parseUrgency(rc.SetUrgency); err != nil {
+				return fmt.Errorf("%s: %v", field("set_urgency"), err)
+			}
+		}
+		if rc.Timeout != nil && (*rc.Timeout < 0 || *rc.Timeout > 65535) {
+			return fmt.Errorf("%s: must be between 0 and 65535", field("timeout"))
+		}
+		for _, t := range []struct {
+			name string
+			text string
+			dest **template.Template
+		}{
+			{"rewrite_summary", rc.RewriteSummary, &r.rewriteSummary},
+			{"rewrite_body", rc.RewriteBody, &r.rewriteBody},
+		} {
+			if t.text == "" {
+				continue
+			}
+			*t.dest, err = template.New(t.name).
+				Funcs(templateFuncs(noEscape)).Parse(t.text)
+			if err != nil {
+				return fmt.Errorf("%s: %v", field(t.name), err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	c.rules = rules
+	return nil
+}
+
+// matches returns true if every match of the rule that is set matches n.
+func (r *rule) matches(n *notifEvent) bool {
+	return (r.appName == nil || r.appName.MatchString(n.app_name)) &&
+		(r.summary == nil || r.summary.MatchString(n.text.summary)) &&
+		(r.body == nil || r.body.MatchString(n.text.body)) &&
+		(r.conf.Category == "" || r.conf.Category == n.category) &&
+		(r.conf.Urgency == "" || r.urgency == n.urgency)
+}
+
+// What the rules did to a notification.
+type ruleOutcome struct {
+	// The rules that applied, counting from 1.
+	matched []int
+
+	drop     bool
+	silent   bool
+	markSeen bool
+}
+
+// applyRules applies every rule that matches n to it.
+func (c *Config) applyRules(n *notifEvent) *ruleOutcome {
+	o := &ruleOutcome{}
+	for i, r := range c.rules {
+		if !r.matches(n) {
+			continue
+		}
+		o.matched = append(o.matched, i+1)
+		if r.conf.Drop {
+			o.drop = true
+			return o
+		}
+		o.silent = o.silent || r.conf.Silent
+		o.markSeen = o.markSeen || r.conf.MarkSeen
+		if r.conf.Timeout != nil {
+			n.expire_timeout = int32(*r.conf.Timeout) * 1000
+		}
+
+		// Both rewrites see the text from before either is applied
+		f := &ruleFields{
+			AppName:  n.app_name,
+			Summary:  n.text.summary,
+			Body:     n.text.body,
+			Category: n.category,
+			Urgency:  urgencyName(n.urgency),
+		}
+		if r.rewriteSummary != nil {
+			n.text.summary = r.rewrite(r.rewriteSummary, f)
+		}
+		if r.rewriteBody != nil {
+			n.text.body = r.rewrite(r.rewriteBody, f)
+		}
+		if r.conf.SetUrgency != "" {
+			n.urgency = r.setUrgency
+		}
+	}
+	return o
+}
+
+func (r *rule) rewrite(t *template.Template, f *ruleFields) string {
+	var b strings.Builder
+	if err := t.Execute(&b, f); err != nil {
+		return "template error: " + err.Error()
+	}
+	return b.String()
+}
+
+// The result of "dryrun": what the rules would do to a notification.
+type dryRunResult struct {
+	Matched  []int  `json:"matched"`
+	Action   string `json:"action"`
+	Urgency  string `json:"urgency"`
+	Timeout  int32  `json:"timeout"`
+	Summary  string `json:"summary"`
+	Body     string `json:"body"`
+	MarkSeen bool   `json:"mark_seen"`
+}
+
+func (r *dryRunResult) lines() []string {
+	matched := make([]string, len(r.Matched))
+	for i, m := range r.Matched {
+		matched[i] = strconv.Itoa(m)
+	}
+	return []string{
+		"matched\t" + strings.Join(matched, " "),
+		"action\t" + r.Action,
+		"urgency\t" + r.Urgency,
+		"timeout\t" + strconv.Itoa(int(r.Timeout)),
+		"summary\t" + oneLine(r.Summary),
+		"body\t" + oneLine(r.Body),
+		"mark_seen\t" + strconv.FormatBool(r.MarkSeen),
+	}
+}
+
+// dryRun parses a notification given as "key=value" arguments, such as
+// "app_name=Spotify summary=Now Playing", and returns what the rules would do
+// to it.  Arguments without a known key continue the previous value.
+func (c *Config) dryRun(args []string) (*dryRunResult, error) {
+	n := &notifEvent{urgency: UrgencyNormal, expire_timeout: -1}
+	var value *string
+	for _, arg := range args {
+		key, v, ok := strings.Cut(arg, "=")
+		var dest *string
+		switch key {
+		case "app_name":
+			dest = &n.app_name
+		case "summary":
+			dest = &n.text.summary
+		case "body":
+			dest = &n.text.body
+		case "category":
+			dest = &n.category
+		case "urgency":
+			u, err := parseUrgency(v)
+			if err != nil {
+				return nil, fmt.Errorf("urgency: %v", err)
+			}
+			n.urgency = u
+			value = nil
+			continue
+		}
+		if !ok || dest == nil {
+			if value == nil {
+				return nil, fmt.Errorf("usage: %s key=value...", DryRun)
+			}
+			*value += " " + arg
+			continue
+		}
+		*dest = v
+		value = dest
+	}
+
+	o := c.applyRules(n)
+	r := &dryRunResult{
+		Matched:  o.matched,
+		Action:   "show",
+		Urgency:  urgencyName(n.urgency),
+		Timeout:  n.expire_timeout,
+		Summary:  n.text.summary,
+		Body:     n.text.body,
+		MarkSeen: o.markSeen,
+	}
+	if r.Matched == nil {
+		r.Matched = []int{}
+	}
+	if o.drop {
+		r.Action = "drop"
+	} else if o.silent {
+		r.Action = "silent"
+	}
+	return r, nil
+}
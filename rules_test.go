@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`
+[[rules]]
+app_name = "^Spotify$"
+drop = true
+
+[[rules]]
+app_name = "Discord"
+summary = "typing"
+silent = true
+
+[[rules]]
+category = "email.arrived"
+timeout = 3
+set_urgency = "low"
+rewrite_summary = "mail: {{.Summary | truncate 6}}"
+mark_seen = true
+`), 0600)
+	c, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	nfs, _, signals := newTestState(c)
+
+	send := func(app, summary, category string) uint32 {
+		id := make(chan uint32, 1)
+		nfs.HandleNotifEvent(&notifEvent{
+			app_name:       app,
+			text:           notiftext{nfs.clock.Now(), summary, ""},
+			urgency:        UrgencyNormal,
+			category:       category,
+			expire_timeout: -1,
+			id:             id,
+		})
+		return <-id
+	}
+
+	if id := send("Spotify", "song", ""); id == 0 || nfs.notifList.Len() != 0 {
+		t.Error("dropped notification was stored")
+	}
+	if sig := <-signals; sig.name != "NotificationClosed" {
+		t.Error("dropped notification was not closed")
+	}
+
+	send("Discord", "someone is typing", "")
+	if nfs.notifList.Len() != 1 || nfs.currently_showing != nil {
+		t.Error("silent notification was not stored, or was shown")
+	}
+	if nfs.unreadCount() != 0 {
+		t.Error("silent notification counts as unread")
+	}
+
+	id := send("mail", "hello world", "email.arrived")
+	p := nfs.findNotif(id).Value.(*notif)
+	if p.urgency != UrgencyLow || p.expire_timeout != 3000 ||
+		p.text[0].summary != "mail: hello…" || !p.seen_by_user {
+		t.Error("rule actions not applied:", p)
+	}
+	if nfs.currently_showing == nil || nfs.currently_showing.Value != p {
+		t.Error("marked seen notification was not shown")
+	}
+
+	// A dropped notification closes the one it replaces
+	for len(signals) > 0 {
+		<-signals
+	}
+	replaced := make(chan uint32, 1)
+	nfs.HandleNotifEvent(&notifEvent{
+		app_name:       "Spotify",
+		replaces_id:    id,
+		text:           notiftext{nfs.clock.Now(), "song", ""},
+		expire_timeout: -1,
+		id:             replaced,
+	})
+	if <-replaced != id || nfs.findNotif(id) != nil {
+		t.Error("replaced notification kept after a dropped replacement")
+	}
+	if nfs.currently_showing != nil && nfs.currently_showing.Value == p {
+		t.Error("replaced notification still shown after a dropped replacement")
+	}
+	if sig := <-signals; sig.name != "NotificationClosed" ||
+		sig.body[0] != id || sig.body[1] != uint32(ReasonUndefined) || len(signals) != 0 {
+		t.Error("bad close of the replaced notification:", sig.name, sig.body)
+	}
+
+	r, err := c.dryRun([]string{"app_name=Discord", "summary=is", "typing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != "silent" || len(r.Matched) != 1 || r.Matched[0] != 2 {
+		t.Error("bad dry run:", r)
+	}
+	if _, err := c.dryRun([]string{"nope"}); err == nil {
+		t.Error("dry run accepted a value without a key")
+	}
+
+	c.Rules = []ruleConfig{{AppName: "("}}
+	if c.validate() == nil {
+		t.Error("bad regular expression was accepted")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// The source of the current time and of timers, which tests replace with a
+// clock they can advance by hand.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+}
+
+type clockTimer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+}
+
+// The clock of the real world.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) Chan() <-chan time.Time { return t.C }
+
+// What a deadline is for.
+type timerPurpose int
+
+const (
+	// The notification being shown should stop being shown.
+	TimerExpire timerPurpose = iota
+
+	// A snoozed notification should be shown again.
+	TimerSnooze
+
+	// Do not disturb should be turned on or off.
+	TimerDND
+)
+
+// Deadlines are keyed by the notification they are for, if any, and their
+// purpose.  Scheduling a key that is already scheduled moves its deadline.
+type timerKey struct {
+	id      uint32
+	purpose timerPurpose
+}
+
+// A deadline that has passed.
+type timerEvent struct {
+	key      timerKey
+	deadline time.Time
+}
+
+type deadline struct {
+	key   timerKey
+	at    time.Time
+	index int
+}
+
+// A min-heap of deadlines, earliest first.
+type deadlineHeap []*deadline
+
+func (h deadlineHeap) Len() int { return len(h) }
+
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	d := x.(*deadline)
+	d.index = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
+
+// A scheduler keeps any number of keyed deadlines, using a single timer for
+// the earliest one.  It is owned by the event loop, which waits on C and then
+// collects the deadlines that have passed with Expired, so scheduling never
+// blocks.
+type scheduler struct {
+	clock     clock
+	deadlines deadlineHeap
+	byKey     map[timerKey]*deadline
+
+	// The timer for the earliest deadline, and the deadline it was set for.
+	timer   clockTimer
+	timerAt time.Time
+}
+
+func newScheduler(c clock) *scheduler {
+	return &scheduler{
+		clock: c,
+		byKey: make(map[timerKey]*deadline),
+	}
+}
+
+// Schedule sets the deadline for key, replacing any it already had.
+func (s *scheduler) Schedule(key timerKey, at time.Time) {
+	if d, ok := s.byKey[key]; ok {
+		d.at = at
+		heap.Fix(&s.deadlines, d.index)
+	} else {
+		d := &deadline{key: key, at: at}
+		heap.Push(&s.deadlines, d)
+		s.byKey[key] = d
+	}
+	s.arm()
+}
+
+// After sets the deadline for key to d from now.
+func (s *scheduler) After(key timerKey, d time.Duration) {
+	s.Schedule(key, s.clock.Now().Add(d))
+}
+
+// Cancel removes the deadline for key, if it has one.
+func (s *scheduler) Cancel(key timerKey) {
+	d, ok := s.byKey[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&s.deadlines, d.index)
+	delete(s.byKey, key)
+	s.arm()
+}
+
+// CancelAll removes every deadline with the given purpose.
+func (s *scheduler) CancelAll(purpose timerPurpose) {
+	for key := range s.byKey {
+		if key.purpose == purpose {
+			s.Cancel(key)
+		}
+	}
+}
+
+// Deadline returns the deadline for key, or false if it has none.
+func (s *scheduler) Deadline(key timerKey) (time.Time, bool) {
+	if d, ok := s.byKey[key]; ok {
+		return d.at, true
+	}
+	return time.Time{}, false
+}
+
+// C returns a channel that receives once the earliest deadline has passed,
+// or nil if there are no deadlines.
+func (s *scheduler) C() <-chan time.Time {
+	if s.timer == nil {
+		return nil
+	}
+	return s.timer.Chan()
+}
+
+// Expired removes and returns the deadlines that have passed, earliest
+// first.
+func (s *scheduler) Expired() []timerEvent {
+	now := s.clock.Now()
+	var events []timerEvent
+	for len(s.deadlines) > 0 && !s.deadlines[0].at.After(now) {
+		d := heap.Pop(&s.deadlines).(*deadline)
+		delete(s.byKey, d.key)
+		events = append(events, timerEvent{d.key, d.at})
+	}
+	// The timer may have fired, so it must be replaced even if nothing passed
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.arm()
+	return events
+}
+
+// arm sets the timer for the earliest deadline, if it isn't already.
+func (s *scheduler) arm() {
+	if len(s.deadlines) == 0 {
+		if s.timer != nil {
+			s.timer.Stop()
+			s.timer = nil
+		}
+		return
+	}
+	at := s.deadlines[0].at
+	if s.timer != nil && at.Equal(s.timerAt) {
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = s.clock.NewTimer(at.Sub(s.clock.Now()))
+	s.timerAt = at
+}
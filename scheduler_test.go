@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A clock that only moves when advanced by hand.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at      time.Time
+	c       chan time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 3, 10, 15, 0, 0, 0, time.Local)}
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	t := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.fire()
+	return t
+}
+
+// Advance moves the clock forward, firing the timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+func (c *fakeClock) fire() {
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.stopped {
+			continue
+		}
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.stopped = true
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+func (t *fakeTimer) Chan() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+func TestScheduler(t *testing.T) {
+	c := newFakeClock()
+	s := newScheduler(c)
+	if s.C() != nil {
+		t.Error("scheduler without deadlines has a timer")
+	}
+
+	fired := func() []timerEvent {
+		select {
+		case <-s.C():
+			return s.Expired()
+		default:
+			return nil
+		}
+	}
+
+	a := timerKey{1, TimerExpire}
+	b := timerKey{2, TimerSnooze}
+	d := timerKey{2, TimerDND}
+	s.After(a, 3*time.Second)
+	s.After(b, time.Second)
+	s.After(d, 2*time.Second)
+
+	// Rescheduling and cancelling move the timer
+	s.After(b, 5*time.Second)
+	s.Cancel(d)
+	c.Advance(2 * time.Second)
+	if evs := fired(); len(evs) != 0 {
+		t.Error("deadlines passed early:", evs)
+	}
+
+	c.Advance(4 * time.Second)
+	evs := fired()
+	if len(evs) != 2 || evs[0].key != a || evs[1].key != b {
+		t.Error("deadlines not delivered in order:", evs)
+	}
+	if _, ok := s.Deadline(a); ok || s.C() != nil {
+		t.Error("passed deadlines were not removed")
+	}
+
+	s.After(timerKey{3, TimerSnooze}, time.Second)
+	s.After(timerKey{4, TimerSnooze}, time.Second)
+	s.After(a, time.Second)
+	s.CancelAll(TimerSnooze)
+	c.Advance(time.Second)
+	if evs := fired(); len(evs) != 1 || evs[0].key != a {
+		t.Error("CancelAll left deadlines behind:", evs)
+	}
+}
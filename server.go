@@ -2,11 +2,17 @@ package main
 
 import (
 	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type RemoteButton string
@@ -19,20 +25,254 @@ const (
 	Dismiss                 = "dismiss"
 	DismissAll              = "dismissall"
 	Hide                    = "hide"
+	HideApp                 = "hideapp"
 	HideAll                 = "hideall"
+	DismissApp              = "dismissapp"
+	Goto                    = "goto"
+	Invoke                  = "invoke"
+	Reload                  = "reload"
+	List                    = "list"
+	Show                    = "show"
+	History                 = "history"
+	Count                   = "count"
+	DryRun                  = "dryrun"
+	Dnd                     = "dnd"
+	Snooze                  = "snooze"
 )
 
-func handleClient(conn net.Conn, remote chan<- RemoteButton,
-	newsub, delsub chan<- chan string) {
+// A line sent by a remote client, split into the button and its arguments.
+// For example, "invoke 3 reply" has the button Invoke and the arguments
+// ["3", "reply"].  Once the command has been carried out, the result is sent
+// through reply.
+type remoteCommand struct {
+	button RemoteButton
+	args   []string
+	reply  chan *commandReply
+}
+
+// The outcome of a remoteCommand.  result is only set for queries.
+type commandReply struct {
+	result queryResult
+	err    error
+}
+
+// A request sent by a client using the JSON protocol, such as
+// {"id": 1, "cmd": "invoke", "args": ["3", "reply"]}.  The id is optional,
+// and is sent back in the response.
+type jsonRequest struct {
+	Id   json.RawMessage `json:"id,omitempty"`
+	Cmd  string          `json:"cmd"`
+	Args []string        `json:"args,omitempty"`
+}
+
+// The response to a jsonRequest, whose type is "ok" or "error".  Queries
+// that succeed also have a result.
+type jsonResponse struct {
+	Type    string          `json:"type"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Result  queryResult     `json:"result,omitempty"`
+}
+
+// A connected remote client.
+type client struct {
+	conn net.Conn
+
+	// True once the client has switched to the JSON protocol by sending
+	// "json".
+	json bool
+
+	// Status updates are sent through this channel once the client has
+	// subscribed, in the given format.
+	statusline chan *status
+	subscribed bool
+	format     outputFormat
+}
+
+func (c *client) writeJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not encode response:", err)
+		return
+	}
+	c.conn.Write(append(b, '\n'))
+}
+
+func (c *client) writeStatus(st *status) {
+	io.WriteString(c.conn, c.format.format(st)+"\n")
+}
+
+// respond tells the client whether its request succeeded.  The plain text
+// protocol only sends back the results of queries, so other errors are only
+// logged.
+func (c *client) respond(id json.RawMessage, reply *commandReply) {
+	if !c.json {
+		if reply.err != nil {
+			fmt.Fprintln(os.Stderr, "command failed:", reply.err)
+		} else if reply.result != nil {
+			for _, l := range reply.result.lines() {
+				io.WriteString(c.conn, l+"\n")
+			}
+		}
+		return
+	}
+	if reply.err != nil {
+		c.writeJSON(&jsonResponse{
+			Type:    "error",
+			Id:      id,
+			Message: reply.err.Error(),
+		})
+	} else {
+		c.writeJSON(&jsonResponse{Type: "ok", Id: id, Result: reply.result})
+	}
+}
+
+// run sends cmd to be carried out and waits for the result.  Status updates
+// keep being written while waiting, since the command itself may cause some.
+func (c *client) run(remote chan<- *remoteCommand,
+	cmd *remoteCommand) *commandReply {
+
+	cmd.reply = make(chan *commandReply, 1)
+	for sent := false; !sent; {
+		select {
+		case remote <- cmd:
+			sent = true
+		case st := <-c.statusline:
+			c.writeStatus(st)
+		}
+	}
+	for {
+		select {
+		case reply := <-cmd.reply:
+			return reply
+		case st := <-c.statusline:
+			c.writeStatus(st)
+		}
+	}
+}
+
+// handleLine handles a single line sent by the client.
+func (c *client) handleLine(line string, remote chan<- *remoteCommand,
+	newsub chan<- chan *status) {
+
+	// Bars that send click events can't send anything else once subscribed
+	if f, ok := c.format.(clickableFormat); ok {
+		if cmd := f.click(line); cmd != nil {
+			c.respond(nil, c.run(remote, cmd))
+		}
+		return
+	}
+
+	var id json.RawMessage
+	var fields []string
+	if c.json {
+		var req jsonRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			c.respond(nil, &commandReply{err: fmt.Errorf("bad request: %v", err)})
+			return
+		}
+		id = req.Id
+		fields = append([]string{req.Cmd}, req.Args...)
+	} else {
+		fields = strings.Fields(line)
+	}
+
+	switch fields[0] {
+	case "json":
+		c.json = true
+		c.respond(id, &commandReply{})
+	case "sub":
+		if c.subscribed {
+			c.respond(id, &commandReply{err: errors.New("already subscribed")})
+			return
+		}
+		name := ""
+		if len(fields) > 1 {
+			name = fields[1]
+		}
+		format, err := newOutputFormat(name, c.json)
+		if err != nil {
+			c.respond(id, &commandReply{err: err})
+			return
+		}
+		c.respond(id, &commandReply{})
+		c.format = format
+		for _, l := range format.header() {
+			io.WriteString(c.conn, l+"\n")
+		}
+		c.subscribed = true
+		newsub <- c.statusline
+	default:
+		c.respond(id, c.run(remote, &remoteCommand{
+			button: RemoteButton(fields[0]),
+			args:   fields[1:],
+		}))
+	}
+}
+
+// How long a client has to authenticate before it is disconnected.
+var authTimeout = 10 * time.Second
+
+// authenticate reads the first line sent by a client, which must be
+// "auth <token>".  It returns false, after telling the client why, if the
+// client did not send the right token.
+func authenticate(conn net.Conn, r *bufio.Reader, token string) bool {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	line, err := r.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		io.WriteString(conn, "error: authentication timed out\n")
+		return false
+	}
+
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 2 || fields[0] != "auth" ||
+		subtle.ConstantTimeCompare([]byte(fields[1]), []byte(token)) != 1 {
+
+		io.WriteString(conn, "error: authentication failed\n")
+		return false
+	}
+	return true
+}
+
+// handleClient reads commands from a client until it disconnects.  If token
+// is not "", the client must authenticate with it first.
+func handleClient(conn net.Conn, token string, remote chan<- *remoteCommand,
+	newsub, delsub chan<- chan *status) {
 
 	defer conn.Close()
 
+	r := bufio.NewReader(conn)
+	if token != "" && !authenticate(conn, r, token) {
+		fmt.Fprintln(os.Stderr, "client from", conn.RemoteAddr(),
+			"failed to authenticate")
+		return
+	}
+
 	ch := make(chan string)
 	eCh := make(chan error)
-	statusline := make(chan string)
+	c := &client{
+		conn:       conn,
+		statusline: make(chan *status),
+	}
+
+	defer func() {
+		if !c.subscribed {
+			return
+		}
+		// Keep draining the statusline until unsubscribed, in case a status
+		// update is being sent to this client right now.
+		for {
+			select {
+			case delsub <- c.statusline:
+				return
+			case <-c.statusline:
+			}
+		}
+	}()
 
 	go func(ch chan<- string, eCh chan<- error) {
-		r := bufio.NewReader(conn)
 		for {
 			line, err := r.ReadString('\n')
 			ch <- strings.TrimSpace(line)
@@ -47,34 +287,67 @@ func handleClient(conn net.Conn, remote chan<- RemoteButton,
 		select {
 		case line := <-ch:
 			fmt.Println("<-", line)
-			if line == "sub" {
-				newsub <- statusline
-				defer func() {
-					delsub <- statusline
-				}()
-			} else if line != "" {
-				remote <- RemoteButton(line)
+			if line != "" {
+				c.handleLine(line, remote, newsub)
 			}
-		case status := <-statusline:
-			io.WriteString(conn, status+"\n")
+		case st := <-c.statusline:
+			c.writeStatus(st)
 		case _ = <-eCh:
 			return
 		}
 	}
 }
 
-func StartServer(remote chan<- RemoteButton, newsub, delsub chan<- chan string) {
-	ln, err := net.Listen("tcp", ":8082")
+// listenUnix listens on a Unix socket at path that only the current user can
+// connect to, replacing any socket left behind by a previous instance.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	oldMask := syscall.Umask(0177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenTCP listens on the TCP address in conf, using TLS if a certificate is
+// configured.
+func listenTCP(conf *Config) (net.Listener, error) {
+	if conf.TLSCert == "" {
+		return net.Listen("tcp", conf.Listen)
+	}
+	cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return tls.Listen("tcp", conf.Listen, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+// StartServer accepts clients on ln.  If token is not "", clients must
+// authenticate with it before sending any commands.
+func StartServer(ln net.Listener, token string, remote chan<- *remoteCommand,
+	newsub, delsub chan<- chan *status) {
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Fprintln(os.Stderr, "error when a client connected")
 		} else {
-			go handleClient(conn, remote, newsub, delsub)
+			go handleClient(conn, token, remote, newsub, delsub)
 		}
 	}
 }
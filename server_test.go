@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	try := func(sent string) (bool, string) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		reply := make(chan string)
+		go func() {
+			io.WriteString(client, sent)
+			line, _ := bufio.NewReader(client).ReadString('\n')
+			reply <- line
+		}()
+
+		ok := authenticate(server, bufio.NewReader(server), "secret")
+		server.Close()
+		return ok, <-reply
+	}
+
+	if ok, reply := try("auth secret\n"); !ok || reply != "" {
+		t.Error("client with the right token was rejected:", reply)
+	}
+	if ok, reply := try("auth wrong\n"); ok || reply == "" {
+		t.Error("client with the wrong token was accepted")
+	}
+	if ok, _ := try("nextmsg\n"); ok {
+		t.Error("client that didn't authenticate was accepted")
+	}
+
+	defer func(d time.Duration) { authTimeout = d }(authTimeout)
+	authTimeout = 10 * time.Millisecond
+	if ok, reply := try("auth sec"); ok || reply != "error: authentication timed out\n" {
+		t.Error("client that timed out was not told why:", reply)
+	}
+}
+
+func TestJSONProtocol(t *testing.T) {
+	server, conn := net.Pipe()
+	defer conn.Close()
+
+	remote := make(chan *remoteCommand)
+	newsub := make(chan chan *status)
+	delsub := make(chan chan *status)
+	go handleClient(server, "", remote, newsub, delsub)
+	go func() {
+		for cmd := range remote {
+			if cmd.button == NextMsg {
+				cmd.reply <- &commandReply{}
+			} else if cmd.button == Count {
+				cmd.reply <- &commandReply{result: &countResult{1, 2}}
+			} else {
+				cmd.reply <- &commandReply{err: errors.New("unknown command")}
+			}
+		}
+	}()
+	go func() {
+		sub := <-newsub
+		sub <- &status{text: "1 | 0", id: 1, summary: "1", body: "0",
+			seeking_at: -1, revisions: 1}
+		<-delsub
+	}()
+
+	r := bufio.NewReader(conn)
+	request := func(line string) map[string]interface{} {
+		io.WriteString(conn, line+"\n")
+		reply, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(reply), &v); err != nil {
+			t.Fatal("bad JSON from server:", reply)
+		}
+		return v
+	}
+
+	if v := request("json"); v["type"] != "ok" {
+		t.Error("switching to JSON failed:", v)
+	}
+	if v := request(`{"id": 1, "cmd": "nextmsg"}`); v["type"] != "ok" || v["id"] != 1.0 {
+		t.Error("bad response to nextmsg:", v)
+	}
+	if v := request(`{"id": "a", "cmd": "bogus"}`); v["type"] != "error" ||
+		v["id"] != "a" || v["message"] == "" {
+		t.Error("bad response to unknown command:", v)
+	}
+	if v := request(`{"cmd": "count"}`); v["type"] != "ok" ||
+		v["result"].(map[string]interface{})["total"] != 2.0 {
+		t.Error("bad response to count:", v)
+	}
+	if v := request(`not json`); v["type"] != "error" {
+		t.Error("bad response to malformed request:", v)
+	}
+	if v := request(`{"cmd": "sub"}`); v["type"] != "ok" {
+		t.Error("bad response to sub:", v)
+	}
+	line, _ := r.ReadString('\n')
+	var st jsonStatus
+	if err := json.Unmarshal([]byte(line), &st); err != nil {
+		t.Fatal("bad status event:", line)
+	}
+	if st.Type != "status" || st.Id != 1 || st.Summary != "1" || st.Seeking {
+		t.Error("bad status event:", line)
+	}
+}
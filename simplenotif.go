@@ -1,10 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/godbus/dbus"
+	"net"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 )
 
 func (f *eventHandler) GetCapabilities() ([]string, *dbus.Error) {
@@ -18,11 +21,15 @@ func (eh *eventHandler) Notify(app_name string, replaces_id uint32, app_icon str
 		replaces_id: replaces_id,
 		app_icon:    app_icon,
 		text: notiftext{
-			time:    time.Now(),
+			time:    eh.clock.Now(),
 			summary: summary,
 			body:    body,
 		},
 		actions:        actions,
+		urgency:        hintUrgency(hints),
+		category:       hintString(hints, "category"),
+		transient:      hintBool(hints, "transient"),
+		resident:       hintBool(hints, "resident"),
 		expire_timeout: expire_timeout,
 		id:             getId,
 	}
@@ -31,45 +38,173 @@ func (eh *eventHandler) Notify(app_name string, replaces_id uint32, app_icon str
 	return <-getId, nil
 }
 
+// hintUrgency returns the urgency given in the hints of a notification, or
+// UrgencyNormal if there is none.
+func hintUrgency(hints map[string]dbus.Variant) urgency {
+	v, ok := hints["urgency"]
+	if !ok {
+		return UrgencyNormal
+	}
+	// The spec says this is a byte, but some clients send other integer types
+	var u int64
+	switch x := v.Value().(type) {
+	case byte:
+		u = int64(x)
+	case int32:
+		u = int64(x)
+	case uint32:
+		u = int64(x)
+	case int64:
+		u = x
+	default:
+		return UrgencyNormal
+	}
+	if u < int64(UrgencyLow) || u > int64(UrgencyCritical) {
+		return UrgencyNormal
+	}
+	return urgency(u)
+}
+
+// hintBool returns the value of a boolean hint, or false if it is not set.
+func hintBool(hints map[string]dbus.Variant, name string) bool {
+	v, ok := hints[name]
+	if !ok {
+		return false
+	}
+	// Some clients send booleans as integers
+	switch x := v.Value().(type) {
+	case bool:
+		return x
+	case byte:
+		return x != 0
+	case int32:
+		return x != 0
+	case uint32:
+		return x != 0
+	}
+	return false
+}
+
+// hintString returns the value of a string hint, or "" if it is not set.
+func hintString(hints map[string]dbus.Variant, name string) string {
+	if v, ok := hints[name]; ok {
+		if x, ok := v.Value().(string); ok {
+			return x
+		}
+	}
+	return ""
+}
+
 func (eh *eventHandler) CloseNotification(id uint32) *dbus.Error {
+	eh.close <- id
 	return nil
 }
 
 func (eh *eventHandler) GetServerInformation() (string, string, string, string, *dbus.Error) {
-	return "simplenotif", "https://dkess.me", "0.0.0", "1", nil
+	return eh.name, eh.vendor, eh.version, "1", nil
+}
+
+// EmitSignals emits every signal sent through signals on the session bus.
+func EmitSignals(conn *dbus.Conn, signals <-chan *dbusSignal) {
+	for sig := range signals {
+		err := conn.Emit("/org/freedesktop/Notifications",
+			"org.freedesktop.Notifications."+sig.name, sig.body...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not emit", sig.name, err)
+		}
+	}
+}
+
+// fatal prints an error message and exits.
+func fatal(a ...interface{}) {
+	fmt.Fprintln(os.Stderr, append([]interface{}{"simplenotif:"}, a...)...)
+	os.Exit(1)
 }
 
 func main() {
+	flags := registerConfigFlags()
+	flag.Parse()
+
+	conf, err := flags.load()
+	if err != nil {
+		fatal(err)
+	}
+
+	if flag.Arg(0) == "ctl" {
+		if err := runCtl(conf, flag.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
 	conn, err := dbus.SessionBus()
 	if err != nil {
-		panic(err)
+		fatal("could not connect to the session bus:", err)
 	}
 
 	reply, err := conn.RequestName("org.freedesktop.Notifications",
 		dbus.NameFlagDoNotQueue)
 	if err != nil {
-		panic(err)
+		fatal("could not request the bus name:", err)
 	}
 	if reply != dbus.RequestNameReplyPrimaryOwner {
-		fmt.Fprintln(os.Stderr, "name already taken")
-		os.Exit(1)
+		fatal("name already taken")
 	}
 
-	eh := NewEventHandler()
-	conn.Export(eh, "/org/freedesktop/Notifications",
+	eh := NewEventHandler(conf)
+	err = conn.Export(eh, "/org/freedesktop/Notifications",
 		"org.freedesktop.Notifications")
 	if err != nil {
-		panic(err)
+		fatal("could not export the notification interface:", err)
 	}
 
-	newsub := make(chan chan string)
-	delsub := make(chan chan string)
-	statuschange := make(chan string)
+	// Only the current user can connect to the Unix socket, so only TCP
+	// clients need to authenticate.
+	var listeners []net.Listener
+	var tokens []string
+	if conf.Socket != "" {
+		ln, err := listenUnix(conf.Socket)
+		if err != nil {
+			fatal("could not listen on", conf.Socket+":", err)
+		}
+		listeners = append(listeners, ln)
+		tokens = append(tokens, "")
+	}
+	if conf.TCP {
+		ln, err := listenTCP(conf)
+		if err != nil {
+			fatal("could not listen on", conf.Listen+":", err)
+		}
+		listeners = append(listeners, ln)
+		tokens = append(tokens, conf.Token)
+	}
+
+	// Closing the listeners removes the Unix socket
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		os.Exit(0)
+	}()
+
+	go EmitSignals(conn, eh.signals)
+
+	newsub := make(chan chan *status)
+	delsub := make(chan chan *status)
+	statuschange := make(chan *status)
 
 	go WatchSubscribers(newsub, delsub, statuschange)
 
-	remote := make(chan RemoteButton)
-	go StartServer(remote, newsub, delsub)
+	remote := make(chan *remoteCommand)
+	for i, ln := range listeners {
+		go StartServer(ln, tokens[i], remote, newsub, delsub)
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
-	WatchEvents(eh, statuschange, remote)
+	WatchEvents(eh, statuschange, remote, conf, reload, flags.load)
 }
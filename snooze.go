@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// SnoozeNotif takes the notification with the given id off the statusline,
+// and shows it again as if it had just arrived once d has passed.
+func (s *nfState) SnoozeNotif(id uint32, d time.Duration) error {
+	e := s.findNotif(id)
+	if e == nil {
+		return noSuchNotif(id)
+	}
+	if d <= 0 {
+		return errors.New("snooze duration must be positive")
+	}
+
+	p := e.Value.(*notif)
+	until := s.clock.Now().Add(d)
+	s.sched.Schedule(timerKey{id, TimerSnooze}, until)
+	if e == s.currently_showing {
+		s.cancelExpiry()
+		s.seeking_at = -1
+		defer s.nextStatus(true)
+	}
+	s.markSeen(p)
+	s.recordSnooze(p, until)
+	return nil
+}
+
+// WakeSnoozed brings back a snoozed notification whose time is up.
+func (s *nfState) WakeSnoozed(id uint32) {
+	e := s.findNotif(id)
+	if e == nil {
+		return
+	}
+	p := e.Value.(*notif)
+	s.moveToBack(e)
+	s.setSeen(p, false)
+	s.recordUnseen(p)
+	if s.shouldInterrupt(p.urgency) {
+		s.interrupt()
+	}
+}
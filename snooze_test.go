@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnooze(t *testing.T) {
+	nfs, _, _ := newTestState(defaultConfig())
+
+	n1, _ := makeTestNotif(nfs, 0, "a", "1")
+	n2, _ := makeTestNotif(nfs, 0, "b", "2")
+	if err := nfs.SnoozeNotif(n1, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := nfs.SnoozeNotif(n2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if nfs.currently_showing != nil {
+		t.Error("snoozed notification still shown")
+	}
+
+	// Replacing a snoozed notification doesn't bring it back early
+	makeTestNotif(nfs, n1, "a", "3")
+	if nfs.currently_showing != nil || nfs.unreadCount() != 0 {
+		t.Error("replacing a snoozed notification showed it")
+	}
+
+	advance(nfs, 30*time.Minute)
+	if nfs.currently_showing != nil {
+		t.Error("snoozed notification woke up early")
+	}
+
+	advance(nfs, 2*time.Hour)
+	_, snoozed1 := nfs.sched.Deadline(timerKey{n1, TimerSnooze})
+	_, snoozed2 := nfs.sched.Deadline(timerKey{n2, TimerSnooze})
+	if snoozed1 || snoozed2 {
+		t.Error("woken notifications are still snoozed")
+	}
+	if nfs.notifList.Back().Value.(*notif).id != n1 {
+		t.Error("woken notifications not moved to the back in order")
+	}
+	if nfs.currently_showing == nil ||
+		nfs.currently_showing.Value.(*notif).id != n2 {
+		t.Error("first woken notification not shown")
+	}
+	if nfs.unreadCount() != 1 {
+		t.Error("woken notifications not marked unseen")
+	}
+
+	if nfs.SnoozeNotif(n1, 0) == nil {
+		t.Error("snoozing for no time was accepted")
+	}
+	nfs.SnoozeNotif(n1, time.Hour)
+	nfs.DismissNotif(n1)
+	if _, ok := nfs.sched.Deadline(timerKey{n1, TimerSnooze}); ok {
+		t.Error("dismissed notification is still snoozed")
+	}
+}
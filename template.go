@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// The statusline template used when none is configured.
+const defaultTemplate = `{{if .Seeking}}({{.Age}}) {{end}}` +
+	`{{.Summary}}{{.Separator}}{{.Body}}{{.Actions}}`
+
+// The fields a statusline template can use.
+type templateFields struct {
+	Id       uint32
+	AppName  string
+	AppIcon  string
+	Summary  string
+	Body     string
+	Urgency  string
+	Category string
+
+	// How long ago the message being shown was sent, such as "3m ago" or
+	// "yesterday 14:02".
+	Age string
+
+	// The message being shown, counting from 1, and how many the
+	// notification has.
+	Revision  int
+	Revisions int
+
+	Unread  int
+	Seeking bool
+
+	// The configured separator, and the labels of the notification's actions
+	// if they can be invoked from what is being shown.
+	Separator string
+	Actions   string
+
+	// The statusline rendered by the default or app template, fitted to
+	// display.max_width, for format templates.
+	Text string
+}
+
+// How each output format escapes notification text so that it cannot inject
+// markup.
+var formatEscapers = map[string]func(string) string{
+	"plain":    noEscape,
+	"json":     noEscape,
+	"i3bar":    noEscape,
+	"swaybar":  noEscape,
+	"waybar":   html.EscapeString,
+	"polybar":  lemonbarEscape,
+	"lemonbar": lemonbarEscape,
+	"tmux":     tmuxEscape,
+}
+
+func noEscape(s string) string { return s }
+
+// lemonbar and polybar have no way to escape "%{", which starts a tag, so the
+// brace is swapped for one that looks the same.  A leading brace is swapped
+// too, in case whatever comes before the text ends with "%".
+func lemonbarEscape(s string) string {
+	s = strings.ReplaceAll(oneLine(s), "%{", "%\uff5b")
+	if strings.HasPrefix(s, "{") {
+		s = "\uff5b" + s[1:]
+	}
+	return s
+}
+
+func tmuxEscape(s string) string {
+	return strings.ReplaceAll(oneLine(s), "#", "##")
+}
+
+// templateFuncs returns the helper functions templates can use.  escape
+// escapes text for the output format the template is for.
+func templateFuncs(escape func(string) string) template.FuncMap {
+	return template.FuncMap{
+		"escape":   escape,
+		"truncate": truncate,
+		"pad":      pad,
+	}
+}
+
+// truncate shortens s to at most n cells wide, ending it with "…" if
+// anything was cut off.
+func truncate(n int, s string) string {
+	return truncateWidth(s, n)
+}
+
+// pad adds spaces to the end of s until it is at least n cells wide.
+func pad(n int, s string) string {
+	return padWidth(s, n)
+}
+
+// The compiled templates of a Config.
+type templateSet struct {
+	def     *template.Template
+	apps    map[string]*template.Template
+	formats map[string]*template.Template
+}
+
+// compileTemplates parses the configured templates, so they are ready to be
+// rendered.
+func (c *Config) compileTemplates() error {
+	parse := func(name, text string, escape func(string) string) (*template.Template, error) {
+		t, err := template.New(name).Funcs(templateFuncs(escape)).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("templates.%s: %v", name, err)
+		}
+		return t, nil
+	}
+
+	ts := &templateSet{
+		apps:    make(map[string]*template.Template),
+		formats: make(map[string]*template.Template),
+	}
+	var err error
+	if ts.def, err = parse("default", c.Templates.Default, noEscape); err != nil {
+		return err
+	}
+	for app, text := range c.Templates.Apps {
+		if ts.apps[app], err = parse("apps."+app, text, noEscape); err != nil {
+			return err
+		}
+	}
+	for format, text := range c.Templates.Formats {
+		escape, ok := formatEscapers[format]
+		if !ok {
+			return fmt.Errorf("templates.formats: unknown output format %q", format)
+		}
+		if ts.formats[format], err = parse("formats."+format, text, escape); err != nil {
+			return err
+		}
+	}
+	c.templates = ts
+	return nil
+}
+
+// textTemplate returns the template for the plain text statusline of
+// notifications from app.
+func (c *Config) textTemplate(app string) *template.Template {
+	if t, ok := c.templates.apps[app]; ok {
+		return t
+	}
+	return c.templates.def
+}
+
+// renderTemplate renders a statusline.  If the template fails, the error is
+// shown in its place.
+func renderTemplate(t *template.Template, fields *templateFields) string {
+	var b strings.Builder
+	if err := t.Execute(&b, fields); err != nil {
+		fmt.Fprintln(os.Stderr, "could not render the statusline:", err)
+		return "template error: " + err.Error()
+	}
+	return b.String()
+}
+
+// line returns the statusline for the named output format.  If the format
+// has its own template, its output is used as is, since it may contain
+// markup; otherwise the plain text statusline is escaped for the format.
+func (st *status) line(format string) string {
+	if st.id != 0 && st.fields != nil {
+		if t, ok := st.config().templates.formats[format]; ok {
+			return renderTemplate(t, st.fields)
+		}
+	}
+	return formatEscapers[format](st.text)
+}
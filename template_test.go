@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	c := defaultConfig()
+	c.Templates.Apps = map[string]string{
+		"mail": `{{.Revision}}/{{.Revisions}} {{.Summary | truncate 4}}|{{pad 3 .Urgency}}|`,
+	}
+	c.Templates.Formats = map[string]string{
+		"polybar": `%{F#fff}{{.Body | escape}}%{F-}`,
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	nfs, statuschange, _ := newTestState(c)
+
+	nfs.HandleNotifEvent(&notifEvent{
+		app_name: "mail",
+		text:     notiftext{nfs.clock.Now(), "hello world", "100%"},
+		urgency:  UrgencyLow,
+		id:       make(chan uint32, 1),
+	})
+	st := <-statuschange
+	if st.text != "1/1 hel…|low|" {
+		t.Error("app template not used:", st.text)
+	}
+	if got := st.line("polybar"); got != "%{F#fff}100%%{F-}" {
+		t.Error("format template not used or not escaped:", got)
+	}
+	if got := st.line("tmux"); got != st.text {
+		t.Error("formats without a template should use the statusline:", got)
+	}
+
+	nfs.HandleNotifEvent(&notifEvent{
+		app_name: "other",
+		text:     notiftext{nfs.clock.Now(), "a", "b"},
+		actions:  []string{"default", "Open"},
+		id:       make(chan uint32, 1),
+	})
+	nfs.SeekPrevMsg()
+	nfs.SeekNextMsg()
+	st = <-statuschange
+	for len(statuschange) > 0 {
+		st = <-statuschange
+	}
+	if !strings.HasSuffix(st.text, "a | b [Open]") || !strings.HasPrefix(st.text, "(") {
+		t.Error("default template rendered wrongly:", st.text)
+	}
+
+	// Format templates get the statusline fitted to the display width
+	c.Display.MaxWidth = 4
+	c.Templates.Formats["tmux"] = `<{{.Text | escape}}>`
+	if err := c.compileTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	nfs.updateStatus()
+	st = <-statuschange
+	if got := st.line("tmux"); got != "<(0s…>" {
+		t.Error("format template not given the fitted statusline:", got)
+	}
+
+	c.Templates.Default = "{{.Nope"
+	if c.validate() == nil {
+		t.Error("bad template was accepted")
+	}
+	c.Templates.Default = defaultTemplate
+	c.Templates.Formats = map[string]string{"nope": ""}
+	if c.validate() == nil {
+		t.Error("template for an unknown format was accepted")
+	}
+}
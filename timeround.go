@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
 
 func Round(d, r time.Duration) time.Duration {
 	if r <= 0 {
@@ -20,3 +23,54 @@ func Round(d, r time.Duration) time.Duration {
 	}
 	return d
 }
+
+// The units ages are shown in, finest first.
+var ageUnits = []struct {
+	unit   time.Duration
+	suffix string
+}{
+	{time.Second, "s"},
+	{time.Minute, "m"},
+	{time.Hour, "h"},
+}
+
+// RoundUnit rounds d to the coarsest unit in ageUnits that d is at least one
+// of after rounding, so that 59m40s becomes 1h rather than 60m.  It returns
+// how many of the unit d is, and the unit's suffix.
+func RoundUnit(d time.Duration) (int64, string) {
+	for i, u := range ageUnits[:len(ageUnits)-1] {
+		if r := Round(d, u.unit); r < ageUnits[i+1].unit {
+			return int64(r / u.unit), u.suffix
+		}
+	}
+	u := ageUnits[len(ageUnits)-1]
+	return int64(Round(d, u.unit) / u.unit), u.suffix
+}
+
+// humanAge describes how long before now t was, such as "3m ago".  Anything
+// older than 12 hours that was not sent today is given as the day and time it
+// was sent instead, such as "yesterday 14:02".
+func humanAge(t, now time.Time) string {
+	d := now.Sub(t)
+	if d < 0 {
+		d = 0
+	}
+	y, m, day := t.Date()
+	ny, nm, nday := now.Date()
+	today := y == ny && m == nm && day == nday
+	if d < 12*time.Hour || today {
+		n, unit := RoundUnit(d)
+		return strconv.FormatInt(n, 10) + unit + " ago"
+	}
+
+	ty, tm, tday := now.AddDate(0, 0, -1).Date()
+	switch {
+	case y == ty && m == tm && day == tday:
+		return "yesterday " + t.Format("15:04")
+	case d < 7*24*time.Hour:
+		return t.Format("Mon 15:04")
+	case y == ny:
+		return t.Format("Jan 2 15:04")
+	}
+	return t.Format("Jan 2 2006")
+}
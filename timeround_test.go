@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHumanAge(t *testing.T) {
+	now := time.Date(2020, 3, 10, 15, 0, 0, 0, time.Local)
+	for ago, want := range map[time.Duration]string{
+		0:                     "0s ago",
+		-time.Minute:          "0s ago",
+		5*time.Second + 1e8:   "5s ago",
+		59*time.Second + 6e8:  "1m ago",
+		3*time.Minute + 5e9:   "3m ago",
+		59*time.Minute + 4e10: "1h ago",
+		14 * time.Hour:        "14h ago",
+		16 * time.Hour:        "yesterday 23:00",
+		30 * time.Hour:        "yesterday 09:00",
+		3 * 24 * time.Hour:    "Sat 15:00",
+		30 * 24 * time.Hour:   "Feb 9 15:00",
+		365 * 24 * time.Hour:  "Mar 11 2019",
+	} {
+		if got := humanAge(now.Add(-ago), now); got != want {
+			t.Errorf("%v ago: got %q, want %q", ago, got, want)
+		}
+	}
+}
+
+func TestRefreshAge(t *testing.T) {
+	nfs, statuschange, _ := newTestState(defaultConfig())
+
+	nfs.HandleNotifEvent(&notifEvent{
+		text: notiftext{nfs.clock.Now().Add(-90 * time.Second), "a", "b"},
+		id:   make(chan uint32, 1),
+	})
+	// Seeking into a notification that is already shown doesn't redraw it
+	nfs.SeekPrevMsg()
+	nfs.updateStatus()
+	var st *status
+	for len(statuschange) > 0 {
+		st = <-statuschange
+	}
+	if st.text != "(2m ago) a | b" {
+		t.Fatal("bad statusline while seeking:", st.text)
+	}
+
+	nfs.RefreshAge()
+	if len(statuschange) != 0 {
+		t.Error("statusline redrawn although the age didn't change")
+	}
+
+	nfs.clock.(*fakeClock).Advance(time.Minute)
+	nfs.RefreshAge()
+	if st := <-statuschange; st.text != "(3m ago) a | b" {
+		t.Error("age not refreshed:", st.text)
+	}
+}